@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+
+	"inceptionServer/pkg/tfgraph"
+)
+
+// benchConfig is a configuration to benchmark; the flags of the compare configuration override the base one.
+type benchConfig struct {
+	name        string
+	target      string
+	concurrency int
+	rps         float64
+	duration    time.Duration
+	timeout     time.Duration
+	k           int
+	noCache     bool
+
+	// of the in-process model
+	modeldir     string
+	reuseSession bool
+	maxBatchSize int
+	maxBatchWait time.Duration
+	batchWorkers int
+}
+
+// benchResult is the result of a configuration
+type benchResult struct {
+	Name        string  `json:"name"`
+	Target      string  `json:"target"`
+	Concurrency int     `json:"concurrency"`
+	RPS         float64 `json:"rps"`
+	MaxBatch    int     `json:"max_batch_size,omitempty"`
+	DurationS   float64 `json:"duration_s"`
+
+	Requests int `json:"requests"`
+	Errors   int `json:"errors"`
+	// number of errors by message, e.g. "status 503"
+	ErrorCounts map[string]int `json:"error_counts,omitempty"`
+	// successful requests per second
+	Throughput float64 `json:"throughput"`
+
+	MeanMs float64 `json:"mean_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P90Ms  float64 `json:"p90_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+	MaxMs  float64 `json:"max_ms"`
+
+	// CPU time of the process which predicts: this process, or the server if its /metrics has it;
+	// -1 if unknown. 100 percent is one core.
+	CPUSeconds float64 `json:"cpu_seconds"`
+	CPUPercent float64 `json:"cpu_percent"`
+}
+
+// benchTarget predicts an image
+type benchTarget interface {
+	predict(img []byte) error
+	// cpuSeconds returns the CPU time used by the process which predicts; false if it is unknown
+	cpuSeconds() (float64, bool)
+	Close() error
+}
+
+func benchUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s bench [flags] <file|glob|dir>...\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "Benchmark the predictions of the images by the model in modeldir, or by the server at --target.\n")
+		fmt.Fprintf(os.Stderr, "With --compare, a second configuration is benchmarked, e.g. --compare=\"--max-batch-size=1\".\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+}
+
+// benchFlags binds the flags of a configuration
+func benchFlags(fs *flag.FlagSet, c *benchConfig) {
+	fs.StringVar(&c.target, "target", "", "url of the server to benchmark, e.g. http://localhost:9527; the model in modeldir is run in-process if empty")
+	fs.IntVar(&c.concurrency, "concurrency", 8, "number of concurrent requests")
+	fs.Float64Var(&c.rps, "rps", 0, "requests per second; as fast as possible if 0")
+	fs.DurationVar(&c.duration, "duration", 30*time.Second, "duration of the benchmark")
+	fs.DurationVar(&c.timeout, "timeout", 30*time.Second, "timeout of a request")
+	fs.IntVar(&c.k, "k", 5, "number of labels of each prediction")
+	fs.BoolVar(&c.noCache, "no-cache", true, "ask the server not to return cached predictions")
+	fs.StringVar(&c.modeldir, "modeldir", "./model-data/inception/", "model directory")
+	fs.BoolVar(&c.reuseSession, "reuse-session", true, "reuse the tensorflow sessions between predictions")
+	fs.IntVar(&c.maxBatchSize, "max-batch-size", 8, "max number of images predicted in one batch; batching is disabled if less than 2")
+	fs.DurationVar(&c.maxBatchWait, "max-batch-wait", 5*time.Millisecond, "max time to wait for more images to fill a batch")
+	fs.IntVar(&c.batchWorkers, "batch-workers", 2, "number of batches that can run concurrently")
+}
+
+func (c *benchConfig) check() error {
+	if c.concurrency < 1 || c.duration <= 0 || c.k < 1 || c.rps < 0 {
+		return fmt.Errorf("concurrency, duration and k should be positive, and rps should not be negative")
+	}
+	return nil
+}
+
+// runBench runs the bench command, and returns the exit code.
+func runBench(args []string) int {
+	base := &benchConfig{name: "base"}
+	var compare, output string
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.Usage = benchUsage(fs)
+	addGlogFlags(fs)
+	benchFlags(fs, base)
+	fs.StringVar(&compare, "compare", "", "flags of a second configuration to compare with, e.g. \"--max-batch-size=1\"")
+	fs.StringVar(&output, "json", "", "file to write the results to as json, - for stdout")
+
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "no image file is given")
+		fs.Usage()
+		return exitUsage
+	}
+
+	configs := []*benchConfig{base}
+	if compare != "" {
+		other := *base
+		other.name = compare
+		cfs := flag.NewFlagSet("compare", flag.ContinueOnError)
+		benchFlags(cfs, &other)
+		// keep the values of the base configuration, rather than the defaults
+		fs.Visit(func(f *flag.Flag) {
+			if cfs.Lookup(f.Name) != nil {
+				cfs.Set(f.Name, f.Value.String())
+			}
+		})
+		if err := cfs.Parse(strings.Fields(compare)); err != nil {
+			return exitUsage
+		}
+		configs = append(configs, &other)
+	}
+	for _, c := range configs {
+		if err := c.check(); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitUsage
+		}
+	}
+
+	images, err := readBenchImages(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+
+	results := []*benchResult{}
+	for _, c := range configs {
+		fmt.Fprintf(os.Stderr, "benchmarking %v for %v ...\n", c.name, c.duration)
+		result, err := benchmark(c, images)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to benchmark %v: %v\n", c.name, err)
+			return exitFailed
+		}
+		results = append(results, result)
+	}
+
+	printBenchResults(os.Stdout, results)
+	if output != "" {
+		out, err := openOutput(output, false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open output: %v\n", err)
+			return exitFailed
+		}
+		defer out.Close()
+
+		content, err := json.MarshalIndent(map[string]interface{}{"results": results}, "", "  ")
+		if err == nil {
+			_, err = out.Write(append(content, '\n'))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write results: %v\n", err)
+			return exitFailed
+		}
+	}
+	return exitOK
+}
+
+func readBenchImages(args []string) ([][]byte, error) {
+	files, err := expandPaths(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) < 1 {
+		return nil, fmt.Errorf("no image file is found")
+	}
+
+	images := make([][]byte, 0, len(files))
+	for _, fname := range files {
+		img, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+func newBenchTarget(c *benchConfig) (benchTarget, error) {
+	if c.target != "" {
+		return newHTTPTarget(c), nil
+	}
+
+	// loadModel reads the flags of the serve command
+	modeldir, reuseSession = c.modeldir, c.reuseSession
+	maxBatchSize, maxBatchWait, batchWorkers = c.maxBatchSize, c.maxBatchWait, c.batchWorkers
+	model, err := loadModel(filepath.Base(filepath.Clean(c.modeldir)), c.modeldir)
+	if err != nil {
+		return nil, err
+	}
+	return &modelTarget{model: model, k: c.k, timeout: c.timeout}, nil
+}
+
+/*
+ benchmark sends the images round-robin for the duration of the configuration, either as fast as
+ the workers can, or at the given rate; with a rate, the latency is measured from when a request
+ is due, so the time waiting for a busy worker is counted.
+*/
+func benchmark(c *benchConfig, images [][]byte) (*benchResult, error) {
+	target, err := newBenchTarget(c)
+	if err != nil {
+		return nil, err
+	}
+	defer target.Close()
+
+	// the first prediction starts the sessions
+	if err := target.predict(images[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: warm-up request failed: %v\n", err)
+	}
+
+	var lock sync.Mutex
+	latencies := []time.Duration{}
+	errors := map[string]int{}
+	record := func(latency time.Duration, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			errors[err.Error()]++
+			return
+		}
+		latencies = append(latencies, latency)
+	}
+
+	cpuBegin, cpuKnown := target.cpuSeconds()
+	begin := time.Now()
+	deadline := begin.Add(c.duration)
+
+	// the due time of each request; zero if there is no rate
+	due := make(chan time.Time, c.concurrency)
+	go func() {
+		defer close(due)
+		if c.rps <= 0 {
+			for time.Now().Before(deadline) {
+				due <- time.Time{}
+			}
+			return
+		}
+
+		interval := time.Duration(float64(time.Second) / c.rps)
+		for next := begin; next.Before(deadline); next = next.Add(interval) {
+			if wait := time.Until(next); wait > 0 {
+				time.Sleep(wait)
+			}
+			due <- next
+		}
+	}()
+
+	var wg sync.WaitGroup
+	sent := 0
+	for i := 0; i < c.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range due {
+				if time.Now().After(deadline) {
+					continue
+				}
+				if start.IsZero() {
+					start = time.Now()
+				}
+				lock.Lock()
+				img := images[sent%len(images)]
+				sent++
+				lock.Unlock()
+
+				err := target.predict(img)
+				record(time.Since(start), err)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(begin)
+	cpuEnd, _ := target.cpuSeconds()
+
+	result := &benchResult{
+		Name:        c.name,
+		Target:      c.target,
+		Concurrency: c.concurrency,
+		RPS:         c.rps,
+		DurationS:   elapsed.Seconds(),
+		Requests:    len(latencies),
+		ErrorCounts: errors,
+		Throughput:  float64(len(latencies)) / elapsed.Seconds(),
+		CPUSeconds:  -1,
+		CPUPercent:  -1,
+	}
+	if c.target == "" {
+		result.Target = c.modeldir
+		result.MaxBatch = c.maxBatchSize
+	}
+	for _, n := range errors {
+		result.Errors += n
+	}
+	result.Requests += result.Errors
+	if cpuKnown {
+		result.CPUSeconds = cpuEnd - cpuBegin
+		result.CPUPercent = 100 * result.CPUSeconds / elapsed.Seconds()
+	}
+	setLatencies(result, latencies)
+	return result, nil
+}
+
+func toMs(d time.Duration) float64 {
+	return d.Seconds() * 1000
+}
+
+type byDuration []time.Duration
+
+func (s byDuration) Len() int           { return len(s) }
+func (s byDuration) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byDuration) Less(i, j int) bool { return s[i] < s[j] }
+
+func setLatencies(r *benchResult, latencies []time.Duration) {
+	if len(latencies) < 1 {
+		return
+	}
+	sort.Sort(byDuration(latencies))
+
+	// nearest rank
+	percentile := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(latencies)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return toMs(latencies[i])
+	}
+
+	total := time.Duration(0)
+	for _, d := range latencies {
+		total += d
+	}
+	r.MeanMs = toMs(total / time.Duration(len(latencies)))
+	r.P50Ms = percentile(0.5)
+	r.P90Ms = percentile(0.9)
+	r.P99Ms = percentile(0.99)
+	r.MaxMs = toMs(latencies[len(latencies)-1])
+}
+
+func printBenchResults(w io.Writer, results []*benchResult) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+
+	header := "\t"
+	for _, r := range results {
+		header += r.Name + "\t"
+	}
+	if len(results) == 2 {
+		header += "change\t"
+	}
+	fmt.Fprintln(tw, header)
+
+	row := func(name, format string, value func(r *benchResult) float64) {
+		line := name + "\t"
+		for _, r := range results {
+			if v := value(r); v >= 0 {
+				line += fmt.Sprintf(format, v) + "\t"
+			} else {
+				line += "-\t"
+			}
+		}
+		if len(results) == 2 {
+			a, b := value(results[0]), value(results[1])
+			if a > 0 && b >= 0 {
+				line += fmt.Sprintf("%+.1f%%", 100*(b-a)/a)
+			}
+			line += "\t"
+		}
+		fmt.Fprintln(tw, line)
+	}
+	row("requests", "%.0f", func(r *benchResult) float64 { return float64(r.Requests) })
+	row("errors", "%.0f", func(r *benchResult) float64 { return float64(r.Errors) })
+	row("throughput (/s)", "%.1f", func(r *benchResult) float64 { return r.Throughput })
+	row("mean (ms)", "%.1f", func(r *benchResult) float64 { return r.MeanMs })
+	row("p50 (ms)", "%.1f", func(r *benchResult) float64 { return r.P50Ms })
+	row("p90 (ms)", "%.1f", func(r *benchResult) float64 { return r.P90Ms })
+	row("p99 (ms)", "%.1f", func(r *benchResult) float64 { return r.P99Ms })
+	row("max (ms)", "%.1f", func(r *benchResult) float64 { return r.MaxMs })
+	row("cpu (%)", "%.0f", func(r *benchResult) float64 { return r.CPUPercent })
+
+	for _, r := range results {
+		for msg, n := range r.ErrorCounts {
+			fmt.Fprintf(tw, "%v: %d x %v\t\n", r.Name, n, msg)
+		}
+	}
+}
+
+// modelTarget predicts with the in-process model
+type modelTarget struct {
+	model   *tfgraph.TfModel
+	k       int
+	timeout time.Duration
+}
+
+func (t *modelTarget) predict(img []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+	_, err := t.model.PredictTopK(ctx, img, t.k)
+	return err
+}
+
+func (t *modelTarget) cpuSeconds() (float64, bool) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		glog.Errorf("Failed to get CPU usage: %v", err)
+		return 0, false
+	}
+	seconds := func(t syscall.Timeval) float64 {
+		return float64(t.Sec) + float64(t.Usec)/1e6
+	}
+	return seconds(usage.Utime) + seconds(usage.Stime), true
+}
+
+func (t *modelTarget) Close() error {
+	return t.model.Close()
+}
+
+// httpTarget posts the images to the predict API of a server
+type httpTarget struct {
+	url     string
+	metrics string
+	noCache bool
+	client  *http.Client
+}
+
+func newHTTPTarget(c *benchConfig) *httpTarget {
+	base := strings.TrimSuffix(c.target, "/")
+	return &httpTarget{
+		url:     base + "/api/v1/predict?k=" + strconv.Itoa(c.k),
+		metrics: base + "/metrics",
+		noCache: c.noCache,
+		client: &http.Client{
+			Timeout: c.timeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConnsPerHost: runtime.NumCPU() * 4,
+			},
+		},
+	}
+}
+
+func (t *httpTarget) predict(img []byte) error {
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(img))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if t.noCache {
+		req.Header.Set("Cache-Control", "no-cache")
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// so the connection is reused
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// cpuSeconds reads the process_cpu_seconds_total of the server
+func (t *httpTarget) cpuSeconds() (float64, bool) {
+	resp, err := t.client.Get(t.metrics)
+	if err != nil {
+		glog.V(2).Infof("Failed to get metrics of %v: %v", t.metrics, err)
+		return 0, false
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "process_cpu_seconds_total" {
+			value, err := strconv.ParseFloat(fields[1], 64)
+			return value, err == nil
+		}
+	}
+	return 0, false
+}
+
+func (t *httpTarget) Close() error {
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"inceptionServer/pkg/eval"
+)
+
+// evalOptions are the flags of the eval command
+type evalOptions struct {
+	workers  int
+	aliases  string
+	json     string
+	html     string
+	minTop1  float64
+	progress bool
+}
+
+func evalUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s eval [flags] <dataset>\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "Evaluate the accuracy of the model on a labeled dataset: a dir with a sub dir of images for each class,\n")
+		fmt.Fprintf(os.Stderr, "or a manifest of path,label (.csv, or .jsonl of {\"path\": ..., \"label\": ...}).\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+}
+
+// runEval runs the eval command, and returns the exit code.
+func runEval(args []string) int {
+	opts := &evalOptions{}
+	fs := flag.NewFlagSet("eval", flag.ContinueOnError)
+	fs.Usage = evalUsage(fs)
+	addGlogFlags(fs)
+	fs.StringVar(&modeldir, "modeldir", "./model-data/inception/", "model directory")
+	fs.BoolVar(&reuseSession, "reuse-session", true, "reuse the tensorflow sessions between predictions")
+	fs.IntVar(&maxBatchSize, "max-batch-size", 8, "max number of images predicted in one batch; batching is disabled if less than 2")
+	fs.DurationVar(&maxBatchWait, "max-batch-wait", 5*time.Millisecond, "max time to wait for more images to fill a batch")
+	fs.IntVar(&batchWorkers, "batch-workers", 2, "number of batches that can run concurrently")
+	fs.IntVar(&opts.workers, "workers", 8, "number of images classified concurrently")
+	fs.StringVar(&opts.aliases, "aliases", "", "json file mapping the classes of the dataset to lists of model labels, e.g. {\"cat\": [\"tabby\", \"tiger cat\"]}")
+	fs.StringVar(&opts.json, "json", "", "file to write the json report to")
+	fs.StringVar(&opts.html, "html", "", "file to write the html report to")
+	fs.Float64Var(&opts.minTop1, "min-top1", 0, "exit with 1 if the top-1 accuracy is lower, e.g. 0.7")
+	fs.BoolVar(&opts.progress, "progress", true, "show a progress bar on stderr")
+
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "one dataset should be given")
+		fs.Usage()
+		return exitUsage
+	}
+	if opts.workers < 1 {
+		fmt.Fprintln(os.Stderr, "workers should be positive")
+		return exitUsage
+	}
+
+	dataset := fs.Arg(0)
+	samples, err := eval.LoadDataset(dataset)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load dataset: %v\n", err)
+		return exitFailed
+	}
+	byPath := make(map[string]*eval.Sample, len(samples))
+	files := make([]string, 0, len(samples))
+	for _, s := range samples {
+		s.Path = filepath.Clean(s.Path)
+		if other, exist := byPath[s.Path]; exist {
+			fmt.Fprintf(os.Stderr, "image %v is labeled twice: %v and %v\n", s.Path, other.Label, s.Label)
+			return exitFailed
+		}
+		byPath[s.Path] = s
+		files = append(files, s.Path)
+	}
+
+	var aliases map[string][]string
+	if opts.aliases != "" {
+		if aliases, err = eval.LoadAliases(opts.aliases); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitFailed
+		}
+	}
+
+	model, err := loadModel(filepath.Base(filepath.Clean(modeldir)), modeldir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load model from %v: %v\n", modeldir, err)
+		return exitFailed
+	}
+	defer model.Close()
+
+	classes := eval.Classes(samples)
+	labels, err := eval.NewLabelMap(classes, model.GetLabels(), aliases)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitFailed
+	}
+	if unmapped := labels.Unmapped(); len(unmapped) > 0 {
+		fmt.Fprintf(os.Stderr, "warning: %d of %d classes match no label of the model, use --aliases to map them: %v\n",
+			len(unmapped), len(classes), unmapped)
+	}
+
+	begin := time.Now()
+	evaluator := eval.NewEvaluator(classes, labels)
+	progress := newProgressBar(len(files), opts.progress)
+	for record := range predictFiles(model, files, &predictOptions{k: eval.TopK, workers: opts.workers}) {
+		if record.Error != "" {
+			evaluator.AddFailure(byPath[record.Path], record.Error)
+		} else {
+			evaluator.Add(byPath[record.Path], record.Labels)
+		}
+		progress.Add(record.Error != "")
+	}
+	progress.Finish()
+
+	info := model.Info()
+	report := evaluator.Report()
+	report.Model = info.ID
+	report.Version = info.Version
+	report.Dataset = dataset
+	report.ElapsedMs = time.Since(begin).Seconds() * 1000
+
+	if err := report.WriteText(os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write report: %v\n", err)
+		return exitFailed
+	}
+	if err := writeReport(opts.json, report.WriteJSON); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write json report: %v\n", err)
+		return exitFailed
+	}
+	if err := writeReport(opts.html, report.WriteHTML); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write html report: %v\n", err)
+		return exitFailed
+	}
+
+	if report.Evaluated < 1 {
+		fmt.Fprintln(os.Stderr, "no image is evaluated")
+		return exitFailed
+	}
+	if report.Top1Accuracy < opts.minTop1 {
+		fmt.Fprintf(os.Stderr, "top-1 accuracy %.4f is lower than %.4f\n", report.Top1Accuracy, opts.minTop1)
+		return exitFailed
+	}
+	return exitOK
+}
+
+// writeReport writes the report to the file; nothing is written if fname is empty.
+func writeReport(fname string, write func(io.Writer) error) error {
+	if fname == "" {
+		return nil
+	}
+
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -6,14 +6,21 @@ import (
 	"math/rand"
 	"time"
 	"github.com/golang/glog"
-	"path/filepath"
-	"io/ioutil"
-	"strings"
 	"runtime"
+	"strings"
+	"path/filepath"
+	"os"
 
 	tfmodel "inceptionServer/pkg/model"
-	iserver "inceptionServer/pkg/server"
+	"inceptionServer/pkg/tfgraph"
+
+)
 
+const (
+	// exit codes of the commands
+	exitOK     = 0
+	exitFailed = 1
+	exitUsage  = 2
 )
 
 var (
@@ -21,125 +28,170 @@ var (
 	imgfile  string
 	imgdir string
 	port int
+	reuseSession bool
+	maxBatchSize int
+	maxBatchWait time.Duration
+	batchWorkers int
+	watchMode string
+	pollInterval time.Duration
+	similarityIndex string
+	labelTopK int
+	cacheMaxEntries int
+	cacheMaxBytes int64
+	inputCacheBytes int64
+	keepImageBytes bool
+	loadWorkers int
+	storePath string
+	models modelFlags
+	modelCheckInterval time.Duration
+	reloadAPI bool
+	shutdownTimeout time.Duration
+	shutdownDelay time.Duration
+	requestTimeout time.Duration
+	maxInflight int
+	maxQueue int
+	maxQueueWait time.Duration
 )
 
+// modelFlags collects the repeated --model name=dir flags
+type modelFlags []string
+
+func (f *modelFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *modelFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("model should be name=dir: %v", value)
+	}
+	*f = append(*f, value)
+	return nil
+}
+
 func init() {
 	rand.Seed(time.Now().UTC().UnixNano())
 	runtime.GOMAXPROCS(runtime.NumCPU())
 }
 
-func setFlags() error {
-	flag.StringVar(&modeldir, "modeldir", "./model-data/inception/", "model directory")
-	flag.StringVar(&imgfile, "imgfile", "", "path to the image file, for example ./imgs/cat.jpg")
-	flag.StringVar(&imgdir, "imgdir", "/tmp/imgs/", "path to the image files")
-	flag.IntVar(&port, "port", 9527, "port to listen on")
-
-	flag.Parse()
-	if modeldir == "" {
-		fmt.Println("modeldir must be provided.")
-		flag.Usage()
-		return fmt.Errorf("wrong parameter")
+func loadModel(name, dir string) (*tfgraph.TfModel, error) {
+	model := tfgraph.NewModel(dir)
+	model.ID = name
+	model.ReuseSession = reuseSession
+	if err := model.Init(); err != nil {
+		glog.Errorf("Failed to load model %v from %v: %v", name, dir, err)
+		return nil, err
 	}
-
-	return nil
+	model.EnableBatching(maxBatchSize, maxBatchWait, batchWorkers)
+	glog.V(2).Infof("Load model %v(%v) successfully.", name, dir)
+	return model, nil
 }
 
-func loadImages(dir string) (*tfmodel.ImageDB, error) {
-	imgDB := tfmodel.NewImageDB()
-
-	files, err := ioutil.ReadDir(dir)
-	if err != nil {
-		glog.Errorf("Failed to readDir %v: %v", dir, err)
-		return nil, fmt.Errorf("Failed to load data: %v", err)
+func loadModels() (*tfmodel.Registry, error) {
+	registry := tfmodel.NewRegistry()
+	if len(models) < 1 {
+		models = append(models, filepath.Base(filepath.Clean(modeldir)) + "=" + modeldir)
 	}
 
-	for _, file := range files {
-		fname := file.Name()
-		if !strings.HasSuffix(fname, "jpg") {
-			continue
+	for _, value := range models {
+		parts := strings.SplitN(value, "=", 2)
+		name, dir := parts[0], parts[1]
+		model, err := tfgraph.NewReloadableModel(name, dir, func() (*tfgraph.TfModel, error) {
+			return loadModel(name, dir)
+		})
+		if err != nil {
+			registry.Close()
+			return nil, err
 		}
-
-		fname = filepath.Join(dir, file.Name())
-		if err := imgDB.Load(fname); err != nil {
-			glog.Errorf("failed to generate tensor from file %v: %v", fname, err)
-			continue
+		if modelCheckInterval > 0 {
+			model.WatchFiles(modelCheckInterval)
 		}
-	}
 
-	if imgDB.Size() < 1 {
-		return nil, fmt.Errorf("No jpg image in dir %v", dir)
+		if err := registry.Add(parts[0], model); err != nil {
+			model.Close()
+			registry.Close()
+			return nil, err
+		}
 	}
 
-	return imgDB, nil
+	return registry, nil
 }
 
-func testImageDB(db *tfmodel.ImageDB, model *tfmodel.TfModel) {
-	fname, err := db.GetRandomImage()
-	if err != nil {
-		glog.Errorf("Failed to fecth a fname.")
-		return
-	}
-
-	tensor, err := db.GetTensor(fname)
-	if err != nil {
-		glog.Errorf("Failed to get tensor from ImageDB: %v", err)
-		return
-	}
-
-	fmt.Printf("fname:%v\n", fname)
-	result, err := model.PredictTopKTensor(tensor, 5)
-	if err != nil {
-		glog.Errorf("Failed to predict %v: %v", fname, err)
-		return
-	}
+// command is a subcommand of the binary; run returns the exit code.
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
 
-	fmt.Println(result.String())
+var commands = []*command{
+	{"serve", "load the models and the images, and serve the predictions over http (default)", runServe},
+	{"predict", "classify image files without the server", runPredict},
+	{"model", "download, verify or describe a model", runModel},
+	{"bench", "benchmark the predictions of a model or a server", runBench},
+	{"eval", "evaluate the accuracy of a model on a labeled dataset", runEval},
+	{"version", "print the version", runVersion},
 }
 
-func testFile(imgfile string, model *tfmodel.TfModel) {
-	result, err := model.PredictTopkFile(imgfile, 5)
-	if err != nil {
-		glog.Errorf("Failed to predict %v: %v", imgfile, err)
-		return
+func usage() {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags] [args]\n\nCommands:\n", name)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s%s\n", cmd.name, cmd.usage)
 	}
-
-	fmt.Println(result.String())
+	fmt.Fprintf(os.Stderr, "\nThe flags without a command are the flags of serve.\n")
+	fmt.Fprintf(os.Stderr, "Run '%s <command> --help' for the flags of a command.\n", name)
 }
 
+// addGlogFlags makes the glog flags, e.g. --v and --logtostderr, available in the flag set of a command
+func addGlogFlags(fs *flag.FlagSet) {
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if fs.Lookup(f.Name) == nil {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+}
 
-func main() {
-	if err := setFlags(); err != nil {
-		fmt.Println("Wrong parameters")
-		return
+// findCommand returns the command to run and its args; serve is run if no command is given.
+// nil is returned for help, or an unknown command.
+func findCommand(args []string) (*command, []string) {
+	if len(args) < 1 {
+		return commands[0], args
 	}
-
-	//1. load the model
-	model := tfmodel.NewModel(modeldir)
-	if err := model.Init(); err != nil {
-		glog.Errorf("Failed to load model %v: %v", modeldir, err)
-		return
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		return nil, args
 	}
-	glog.V(2).Infof("Load model(%v) successfully.", modeldir)
-
-	if len(imgfile) > 0 {
-		testFile(imgfile, model)
+	if strings.HasPrefix(args[0], "-") {
+		return commands[0], args
 	}
 
-	//2. load the images, and transform it
-	images, err := loadImages(imgdir)
-	if err != nil {
-		glog.Errorf("Failed to load images from dir %v: %v", imgdir, err)
-		return
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd, args[1:]
+		}
 	}
-	testImageDB(images, model)
+	return nil, args
+}
 
-	//3. construct the server
-	server := iserver.NewInceptionServer(port, model)
-	server.SetImages(images)
-	server.Print()
-	server.Run()
+func main() {
+	// glog complains about logging before flag.Parse; the flags are parsed by the commands
+	flag.CommandLine.Parse([]string{})
+
+	cmd, args := findCommand(os.Args[1:])
+	code := exitOK
+	if cmd != nil {
+		code = cmd.run(args)
+	} else {
+		switch args[0] {
+		case "help", "-h", "-help", "--help":
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command: %v\n\n", args[0])
+			code = exitUsage
+		}
+		usage()
+	}
 
-	glog.V(2).Infof("hello")
-	return
+	glog.Flush()
+	os.Exit(code)
 }
-
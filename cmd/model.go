@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	tfmodel "inceptionServer/pkg/model"
+	"inceptionServer/pkg/tfgraph"
+)
+
+// modelInfo is printed by the model info command
+type modelInfo struct {
+	*tfmodel.ModelInfo
+	ModelFile string               `json:"model_file"`
+	LabelFile string               `json:"label_file"`
+	Config    *tfmodel.ModelConfig `json:"config"`
+}
+
+func modelUsage() {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s model <download|verify|info> [flags]\n\n", name)
+	fmt.Fprintf(os.Stderr, "  download  download the model files into modeldir, if they are missing\n")
+	fmt.Fprintf(os.Stderr, "  verify    load the model, and check that it predicts\n")
+	fmt.Fprintf(os.Stderr, "  info      print the manifest, the checksum and the version of the model as json\n")
+	fmt.Fprintf(os.Stderr, "\nRun '%s model <command> --help' for the flags of a command.\n", name)
+}
+
+func modelFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet("model "+name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s model %s [flags]\n", filepath.Base(os.Args[0]), name)
+		fmt.Fprintf(os.Stderr, "%s\n\nFlags:\n", usage)
+		fs.PrintDefaults()
+	}
+	addGlogFlags(fs)
+	fs.StringVar(&modeldir, "modeldir", "./model-data/inception/", "model directory")
+	return fs
+}
+
+// runModel runs the model command, and returns the exit code.
+func runModel(args []string) int {
+	if len(args) < 1 {
+		modelUsage()
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "download":
+		return runModelDownload(args[1:])
+	case "verify":
+		return runModelVerify(args[1:])
+	case "info":
+		return runModelInfo(args[1:])
+	case "help", "-h", "-help", "--help":
+		modelUsage()
+		return exitOK
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown model command: %v\n\n", args[0])
+	modelUsage()
+	return exitUsage
+}
+
+func runModelDownload(args []string) int {
+	fs := modelFlagSet("download", "Download the model files into modeldir from the download_url of its manifest, if they are missing.")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	modelfile, labelfile, err := tfgraph.DownloadModel(modeldir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to download model into %v: %v\n", modeldir, err)
+		return exitFailed
+	}
+	fmt.Printf("model file: %v\nlabel file: %v\n", modelfile, labelfile)
+	return exitOK
+}
+
+// loadModelFiles loads the model in modeldir, without downloading the missing files.
+func loadModelFiles() (*tfgraph.TfModel, string, string, error) {
+	modelfile, labelfile, err := tfgraph.ModelFiles(modeldir)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if err := tfmodel.FilesExist(modelfile, labelfile); err != nil {
+		return nil, "", "", fmt.Errorf("%v; run the model download command first", err)
+	}
+
+	model := tfgraph.NewModel(modeldir)
+	model.ReuseSession = reuseSession
+	if err := model.Init(); err != nil {
+		return nil, "", "", err
+	}
+	return model, modelfile, labelfile, nil
+}
+
+func runModelVerify(args []string) int {
+	fs := modelFlagSet("verify", "Load the model in modeldir, and check that it predicts a generated image, and the image file if it is given.")
+	fs.BoolVar(&reuseSession, "reuse-session", true, "reuse the tensorflow sessions between predictions")
+	fs.StringVar(&imgfile, "imgfile", "", "an image file to predict, for example ./imgs/cat.jpg")
+	k := fs.Int("k", 5, "number of labels predicted for imgfile")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	model, _, _, err := loadModelFiles()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load model from %v: %v\n", modeldir, err)
+		return exitFailed
+	}
+	defer model.Close()
+
+	if err := model.Verify(); err != nil {
+		fmt.Fprintf(os.Stderr, "model %v failed to predict: %v\n", modeldir, err)
+		return exitFailed
+	}
+
+	if imgfile != "" {
+		bytes, err := ioutil.ReadFile(imgfile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read image file %v: %v\n", imgfile, err)
+			return exitFailed
+		}
+		result, err := model.PredictTopK(context.Background(), bytes, *k)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to predict %v: %v\n", imgfile, err)
+			return exitFailed
+		}
+		fmt.Println(result.String())
+	}
+
+	info := model.Info()
+	fmt.Printf("model %v is OK: version %v, %d labels, loaded in %.1f ms\n", info.ID, info.Version, info.NumLabels, info.LoadMs)
+	return exitOK
+}
+
+func runModelInfo(args []string) int {
+	fs := modelFlagSet("info", "Print the manifest, the checksum and the version of the model in modeldir as json.")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	// the sessions are not needed
+	reuseSession = false
+	model, modelfile, labelfile, err := loadModelFiles()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load model from %v: %v\n", modeldir, err)
+		return exitFailed
+	}
+	defer model.Close()
+
+	content, err := json.MarshalIndent(&modelInfo{
+		ModelInfo: model.Info(),
+		ModelFile: modelfile,
+		LabelFile: labelfile,
+		Config:    model.Config,
+	}, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode model info: %v\n", err)
+		return exitFailed
+	}
+	fmt.Println(string(content))
+	return exitOK
+}
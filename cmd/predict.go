@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	tfmodel "inceptionServer/pkg/model"
+)
+
+const (
+	formatJSONL = "jsonl"
+	formatCSV   = "csv"
+	formatTable = "table"
+)
+
+// predictOptions are the flags of the predict command
+type predictOptions struct {
+	k          int
+	workers    int
+	format     string
+	output     string
+	checkpoint string
+	progress   bool
+}
+
+// predictRecord is the result of an image file
+type predictRecord struct {
+	Path      string                 `json:"path"`
+	Model     string                 `json:"model,omitempty"`
+	Labels    []*tfmodel.LabelWeight `json:"labels,omitempty"`
+	PredictMs float64                `json:"predict_ms,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+}
+
+func predictUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s predict [flags] <file|glob|dir>...\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "Classify the image files, globs and dirs (recursively), without starting the server.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+}
+
+// runPredict runs the predict command, and returns the exit code.
+func runPredict(args []string) int {
+	opts := &predictOptions{}
+	fs := flag.NewFlagSet("predict", flag.ContinueOnError)
+	fs.Usage = predictUsage(fs)
+	addGlogFlags(fs)
+	fs.StringVar(&modeldir, "modeldir", "./model-data/inception/", "model directory")
+	fs.BoolVar(&reuseSession, "reuse-session", true, "reuse the tensorflow sessions between predictions")
+	fs.IntVar(&maxBatchSize, "max-batch-size", 8, "max number of images predicted in one batch; batching is disabled if less than 2")
+	fs.DurationVar(&maxBatchWait, "max-batch-wait", 5*time.Millisecond, "max time to wait for more images to fill a batch")
+	fs.IntVar(&batchWorkers, "batch-workers", 2, "number of batches that can run concurrently")
+	fs.IntVar(&opts.k, "k", 5, "number of labels of each image")
+	fs.IntVar(&opts.workers, "workers", 8, "number of images classified concurrently")
+	fs.StringVar(&opts.format, "format", formatJSONL, "output format: jsonl, csv or table")
+	fs.StringVar(&opts.output, "output", "", "output file; stdout if empty")
+	fs.StringVar(&opts.checkpoint, "checkpoint", "", "file of the finished images, including the failed ones; if it exists, they are skipped, and the output is appended")
+	fs.BoolVar(&opts.progress, "progress", true, "show a progress bar on stderr")
+
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "no image file is given")
+		fs.Usage()
+		return exitUsage
+	}
+	if opts.format != formatJSONL && opts.format != formatCSV && opts.format != formatTable {
+		fmt.Fprintf(os.Stderr, "unknown format: %v\n", opts.format)
+		return exitUsage
+	}
+	if opts.k < 1 || opts.workers < 1 {
+		fmt.Fprintln(os.Stderr, "k and workers should be positive")
+		return exitUsage
+	}
+
+	files, err := expandPaths(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+
+	done := map[string]bool{}
+	if opts.checkpoint != "" {
+		if done, err = readCheckpoint(opts.checkpoint); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read checkpoint: %v\n", err)
+			return exitFailed
+		}
+	}
+	todo := []string{}
+	for _, fname := range files {
+		if !done[fname] {
+			todo = append(todo, fname)
+		}
+	}
+
+	model, err := loadModel(filepath.Base(filepath.Clean(modeldir)), modeldir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load model from %v: %v\n", modeldir, err)
+		return exitFailed
+	}
+	defer model.Close()
+
+	// resume: append to the output of the last run
+	resume := len(done) > 0
+	out, err := openOutput(opts.output, resume)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open output: %v\n", err)
+		return exitFailed
+	}
+	defer out.Close()
+
+	var checkpoint io.WriteCloser
+	if opts.checkpoint != "" {
+		f, err := os.OpenFile(opts.checkpoint, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open checkpoint: %v\n", err)
+			return exitFailed
+		}
+		defer f.Close()
+		checkpoint = f
+	}
+
+	writer := newRecordWriter(out, opts.format, !resume)
+	progress := newProgressBar(len(todo), opts.progress)
+	failed := []string{}
+
+	for record := range predictFiles(model, todo, opts) {
+		if err := writer.Write(record); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write output: %v\n", err)
+			return exitFailed
+		}
+
+		if record.Error != "" {
+			failed = append(failed, record.Path)
+		}
+		// the failed images are recorded too: their rows are in the output, and they are not appended again
+		if checkpoint != nil {
+			if _, err := fmt.Fprintln(checkpoint, record.Path); err != nil {
+				glog.Errorf("Failed to write checkpoint: %v", err)
+			}
+		}
+		progress.Add(record.Error != "")
+	}
+	if err := writer.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write output: %v\n", err)
+		return exitFailed
+	}
+	progress.Finish()
+
+	fmt.Fprintf(os.Stderr, "%d images: %d succeeded, %d failed, %d skipped by checkpoint\n",
+		len(files), len(todo)-len(failed), len(failed), len(files)-len(todo))
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		for _, fname := range failed {
+			fmt.Fprintf(os.Stderr, "\tfailed: %v\n", fname)
+		}
+		return exitFailed
+	}
+	return exitOK
+}
+
+// expandPaths returns the image files of the files, globs and dirs, without duplicates.
+func expandPaths(args []string) ([]string, error) {
+	result := []string{}
+	seen := map[string]bool{}
+	add := func(fname string) {
+		fname = filepath.Clean(fname)
+		if !seen[fname] {
+			seen[fname] = true
+			result = append(result, fname)
+		}
+	}
+
+	for _, arg := range args {
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %v: %v", arg, err)
+		}
+		if len(matches) < 1 {
+			return nil, fmt.Errorf("no file matches %v", arg)
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				// the files given explicitly are classified whatever their extensions are
+				if match == arg || tfmodel.IsImageFile(match) {
+					add(match)
+				}
+				continue
+			}
+
+			err = filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !info.IsDir() && tfmodel.IsImageFile(path) {
+					add(path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to walk %v: %v", match, err)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func readCheckpoint(fname string) (map[string]bool, error) {
+	result := map[string]bool{}
+	f, err := os.Open(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			result[line] = true
+		}
+	}
+	return result, scanner.Err()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func openOutput(fname string, appendTo bool) (io.WriteCloser, error) {
+	if fname == "" || fname == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appendTo {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	return os.OpenFile(fname, flags, 0644)
+}
+
+// predictFiles classifies the files with a pool of workers; the records are sent as they finish.
+func predictFiles(model tfmodel.Classifier, files []string, opts *predictOptions) <-chan *predictRecord {
+	paths := make(chan string)
+	records := make(chan *predictRecord, opts.workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fname := range paths {
+				records <- predictFile(model, fname, opts.k)
+			}
+		}()
+	}
+
+	go func() {
+		for _, fname := range files {
+			paths <- fname
+		}
+		close(paths)
+		wg.Wait()
+		close(records)
+	}()
+
+	return records
+}
+
+func predictFile(model tfmodel.Classifier, fname string, k int) *predictRecord {
+	record := &predictRecord{Path: fname}
+
+	bytes, err := ioutil.ReadFile(fname)
+	if err != nil {
+		record.Error = err.Error()
+		return record
+	}
+
+	result, err := model.PredictTopK(context.Background(), bytes, k)
+	if err != nil {
+		glog.Errorf("Failed to predict %v: %v", fname, err)
+		record.Error = err.Error()
+		return record
+	}
+
+	record.Model = result.Model
+	record.Labels = result.Labels
+	record.PredictMs = result.PredictMs
+	return record
+}
+
+// recordWriter writes the records in one of the formats
+type recordWriter struct {
+	format string
+	w      *bufio.Writer
+	csv    *csv.Writer
+	header bool
+}
+
+func newRecordWriter(out io.Writer, format string, header bool) *recordWriter {
+	w := bufio.NewWriter(out)
+	return &recordWriter{
+		format: format,
+		w:      w,
+		csv:    csv.NewWriter(w),
+		header: header,
+	}
+}
+
+func (rw *recordWriter) Write(r *predictRecord) error {
+	switch rw.format {
+	case formatCSV:
+		return rw.writeCSV(r)
+	case formatTable:
+		return rw.writeTable(r)
+	}
+
+	content, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := rw.w.Write(append(content, '\n')); err != nil {
+		return err
+	}
+	// so the output matches the checkpoint if the run is interrupted
+	return rw.w.Flush()
+}
+
+// one row per label: path,model,rank,label,probability,error
+func (rw *recordWriter) writeCSV(r *predictRecord) error {
+	if rw.header {
+		rw.header = false
+		if err := rw.csv.Write([]string{"path", "model", "rank", "label", "probability", "error"}); err != nil {
+			return err
+		}
+	}
+
+	if r.Error != "" {
+		if err := rw.csv.Write([]string{r.Path, r.Model, "", "", "", r.Error}); err != nil {
+			return err
+		}
+	}
+	for i, lw := range r.Labels {
+		row := []string{r.Path, r.Model, strconv.Itoa(i + 1), lw.Label, strconv.FormatFloat(float64(lw.Weight), 'f', 6, 32), ""}
+		if err := rw.csv.Write(row); err != nil {
+			return err
+		}
+	}
+	rw.csv.Flush()
+	if err := rw.csv.Error(); err != nil {
+		return err
+	}
+	return rw.w.Flush()
+}
+
+func (rw *recordWriter) writeTable(r *predictRecord) error {
+	if rw.header {
+		rw.header = false
+		fmt.Fprintf(rw.w, "%-48s  %-32s  %s\n", "PATH", "LABEL", "PROBABILITY")
+	}
+
+	if r.Error != "" {
+		fmt.Fprintf(rw.w, "%-48s  ERROR: %s\n", r.Path, r.Error)
+	}
+	for i, lw := range r.Labels {
+		path := r.Path
+		if i > 0 {
+			path = ""
+		}
+		fmt.Fprintf(rw.w, "%-48s  %-32s  %.4f\n", path, lw.Label, lw.Weight)
+	}
+	return rw.w.Flush()
+}
+
+func (rw *recordWriter) Flush() error {
+	rw.csv.Flush()
+	if err := rw.csv.Error(); err != nil {
+		return err
+	}
+	return rw.w.Flush()
+}
+
+// progressBar is drawn on stderr
+type progressBar struct {
+	enabled bool
+	total   int
+	done    int
+	failed  int
+	begin   time.Time
+	last    time.Time
+}
+
+const progressWidth = 40
+
+func newProgressBar(total int, enabled bool) *progressBar {
+	return &progressBar{
+		enabled: enabled,
+		total:   total,
+		begin:   time.Now(),
+	}
+}
+
+func (p *progressBar) Add(failed bool) {
+	p.done++
+	if failed {
+		p.failed++
+	}
+
+	// redraw at most 10 times a second
+	if time.Since(p.last) < 100*time.Millisecond && p.done < p.total {
+		return
+	}
+	p.last = time.Now()
+	p.draw()
+}
+
+func (p *progressBar) draw() {
+	if !p.enabled || p.total < 1 {
+		return
+	}
+
+	filled := progressWidth * p.done / p.total
+	elapsed := time.Since(p.begin)
+	rate := float64(p.done) / elapsed.Seconds()
+	eta := time.Duration(0)
+	if rate > 0 {
+		eta = time.Duration(float64(p.total-p.done)/rate) * time.Second
+	}
+
+	fmt.Fprintf(os.Stderr, "\r[%s%s] %d/%d %3d%% %d failed %.1f/s ETA %v ",
+		strings.Repeat("#", filled), strings.Repeat(".", progressWidth-filled),
+		p.done, p.total, 100*p.done/p.total, p.failed, rate, eta)
+}
+
+func (p *progressBar) Finish() {
+	if !p.enabled || p.total < 1 {
+		return
+	}
+	p.draw()
+	fmt.Fprintln(os.Stderr)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+
+	tfmodel "inceptionServer/pkg/model"
+	iserver "inceptionServer/pkg/server"
+	"inceptionServer/pkg/store"
+	"inceptionServer/pkg/tfgraph"
+)
+
+func serveUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [serve] [flags]\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "Load the models and the images, and serve the predictions over http.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+}
+
+// the flags of the serve command; their names are kept from the time there was no command
+func serveFlags(fs *flag.FlagSet) {
+	addGlogFlags(fs)
+	fs.StringVar(&modeldir, "modeldir", "./model-data/inception/", "model directory, used if no --model is given")
+	fs.Var(&models, "model", "a model to load, as name=dir; can be repeated, the first one is the default model")
+	fs.StringVar(&imgfile, "imgfile", "", "path to an image file to predict at startup, for example ./imgs/cat.jpg")
+	fs.StringVar(&imgdir, "imgdir", "/tmp/imgs/", "path to the image files")
+	fs.IntVar(&port, "port", 9527, "port to listen on")
+	fs.BoolVar(&reuseSession, "reuse-session", true, "reuse the tensorflow sessions between predictions")
+	fs.IntVar(&maxBatchSize, "max-batch-size", 8, "max number of images predicted in one batch; batching is disabled if less than 2")
+	fs.DurationVar(&maxBatchWait, "max-batch-wait", 5*time.Millisecond, "max time to wait for more images to fill a batch")
+	fs.IntVar(&batchWorkers, "batch-workers", 2, "number of batches that can run concurrently")
+	fs.BoolVar(&reloadAPI, "enable-reload-api", false, "allow POST /api/v1/models/<name>/reload; it has no authentication")
+	fs.DurationVar(&modelCheckInterval, "model-check-interval", 0, "interval to check the model files, and reload the changed models; 0 to disable")
+	fs.StringVar(&watchMode, "watch-mode", tfmodel.WatchAuto, "how to watch imgdir for new images: auto, inotify, poll or off")
+	fs.DurationVar(&pollInterval, "poll-interval", 10*time.Second, "interval to poll imgdir, if inotify is not used")
+	fs.IntVar(&cacheMaxEntries, "cache-max-entries", 10000, "max number of cached prediction results; 0 disables the cache")
+	fs.Int64Var(&cacheMaxBytes, "cache-max-bytes", 64<<20, "max estimated size of cached prediction results in bytes; 0 disables the cache")
+	fs.Int64Var(&inputCacheBytes, "input-cache-bytes", tfmodel.DefaultInputCacheBytes, "max size of the preprocessed images kept in memory; the others are preprocessed on demand")
+	fs.BoolVar(&keepImageBytes, "keep-image-bytes", true, "keep the image files in memory; if false, they are read from imgdir on demand")
+	fs.IntVar(&loadWorkers, "load-workers", runtime.NumCPU(), "number of goroutines to load and preprocess the images at startup")
+	fs.StringVar(&storePath, "store", "", "file of the store which keeps the images and their predictions across restarts; disabled if empty")
+	fs.IntVar(&labelTopK, "label-topk", 5, "number of predicted labels of each image indexed for label search")
+	fs.StringVar(&similarityIndex, "similarity-index", tfmodel.IndexAuto, "nearest neighbour index of the images: auto, brute or hnsw")
+	fs.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "max time to wait for the requests in flight on SIGINT or SIGTERM")
+	fs.DurationVar(&requestTimeout, "request-timeout", 30*time.Second, "max time to handle a request, the predictions not done in time get 504; 0 for no limit")
+	fs.IntVar(&maxInflight, "max-inflight", 16, "max number of requests running inference; 0 for no limit")
+	fs.IntVar(&maxQueue, "max-queue", 64, "max number of requests waiting for inference, the others get 429; page views are admitted before the api")
+	fs.DurationVar(&maxQueueWait, "max-queue-wait", 2*time.Second, "max time a request waits for inference, then it gets 503")
+	fs.DurationVar(&shutdownDelay, "shutdown-delay", 0, "time to keep serving with /readyz failing on SIGINT or SIGTERM, before draining; so that the load balancers stop sending requests")
+}
+
+// reload all the models on SIGHUP
+func handleReloadSignal(registry *tfmodel.Registry) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	go func() {
+		for range sigs {
+			glog.V(1).Infof("Got SIGHUP, reload the models.")
+			if err := registry.ReloadAll(); err != nil {
+				glog.Errorf("Failed to reload models: %v", err)
+			}
+		}
+	}()
+}
+
+// serveUntilSignal serves until SIGINT or SIGTERM, then drains the requests in flight;
+// a second signal exits at once.
+func serveUntilSignal(server *iserver.InceptionServer) error {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Run()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-sigs:
+		glog.V(1).Infof("Got %v, shutting down in at most %v.", sig, shutdownDelay+shutdownTimeout)
+	}
+
+	go func() {
+		sig := <-sigs
+		glog.Errorf("Got %v again, exit without draining.", sig)
+		glog.Flush()
+		os.Exit(exitFailed)
+	}()
+
+	// the delay is not counted in the time to drain
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownDelay+shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return err
+	}
+	return <-errs
+}
+
+func loadImages(dir string, model tfmodel.Classifier, st tfmodel.Store) (*tfmodel.ImageDB, error) {
+	imgDB := tfmodel.NewImageDB(model)
+	if st != nil {
+		imgDB.SetStore(st)
+	}
+	if err := imgDB.SetIndex(similarityIndex); err != nil {
+		return nil, err
+	}
+	imgDB.SetInputCache(inputCacheBytes)
+	imgDB.SetKeepBytes(keepImageBytes)
+	imgDB.SetLoadWorkers(loadWorkers)
+
+	begin := time.Now()
+	num, err := imgDB.LoadDir(context.Background(), dir)
+	if err != nil {
+		return nil, err
+	}
+	glog.V(1).Infof("Loaded %d images from %v in %v with %d workers.", num, dir, time.Since(begin), loadWorkers)
+
+	if imgDB.Size() < 1 {
+		if watchMode == tfmodel.WatchOff {
+			return nil, fmt.Errorf("No image in dir %v", dir)
+		}
+		glog.Warningf("No image in dir %v yet, waiting for new images.", dir)
+	}
+
+	return imgDB, nil
+}
+
+func testFile(imgfile string, model tfmodel.Classifier) {
+	bytes, err := ioutil.ReadFile(imgfile)
+	if err != nil {
+		glog.Errorf("failed to read image file %v: %v", imgfile, err)
+		return
+	}
+
+	result, err := model.PredictTopK(context.Background(), bytes, 5)
+	if err != nil {
+		glog.Errorf("Failed to predict %v: %v", imgfile, err)
+		return
+	}
+
+	fmt.Println(result.String())
+}
+
+// runServe runs the serve command, and returns the exit code.
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.Usage = serveUsage(fs)
+	serveFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments: %v\n", fs.Args())
+		fs.Usage()
+		return exitUsage
+	}
+	if modeldir == "" && len(models) < 1 {
+		fmt.Fprintln(os.Stderr, "modeldir must be provided.")
+		fs.Usage()
+		return exitUsage
+	}
+
+	//1. load the models
+	registry, err := loadModels()
+	if err != nil {
+		glog.Errorf("Failed to load models: %v", err)
+		return exitFailed
+	}
+	defer registry.Close()
+	model := registry.Default()
+
+	// the cached results of a model are dropped when it is reloaded
+	cache := tfmodel.NewPredictCache(cacheMaxEntries, cacheMaxBytes)
+	for _, name := range registry.Names() {
+		m, _ := registry.Get(name)
+		if reloadable, ok := m.(*tfgraph.ReloadableModel); ok {
+			reloadable.OnReload(func(old, new *tfmodel.ModelInfo) {
+				cache.RemoveModel(reloadable.Info().ID)
+			})
+		}
+	}
+	glog.V(2).Infof("Prediction cache: %v", cache)
+
+	// the stored predictions are reused
+	var st *store.BoltStore
+	if storePath != "" {
+		if st, err = store.Open(storePath); err != nil {
+			glog.Errorf("Failed to open store: %v", err)
+			return exitFailed
+		}
+		defer st.Close()
+		cache.SetStore(st)
+	}
+
+	if len(imgfile) > 0 {
+		testFile(imgfile, model)
+	}
+
+	//2. load the images, and transform it
+	var imgStore tfmodel.Store
+	if st != nil {
+		imgStore = st
+	}
+	images, err := loadImages(imgdir, model, imgStore)
+	if err != nil {
+		glog.Errorf("Failed to load images from dir %v: %v", imgdir, err)
+		return exitFailed
+	}
+
+	labels := tfmodel.NewLabelIndex(images, labelTopK)
+	labels.SetCache(cache)
+	labels.Start()
+	defer labels.Stop()
+
+	// the images should be preprocessed and embedded again if the reloaded model is changed,
+	// e.g., its graph or its preprocessing, and their labels predicted again by the new model.
+	if reloadable, ok := model.(*tfgraph.ReloadableModel); ok {
+		reloadable.OnReload(func(old, new *tfmodel.ModelInfo) {
+			if old.Version != new.Version || old.Checksum != new.Checksum {
+				images.Reprocess()
+			}
+			labels.Invalidate()
+		})
+	}
+	handleReloadSignal(registry)
+
+	// the files created or removed while the dir was loaded are synced by the first scan of the watcher
+	watcher := tfmodel.NewImageWatcher(imgdir, images, watchMode, pollInterval)
+	if err := watcher.Start(); err != nil {
+		glog.Errorf("Failed to watch images dir %v: %v", imgdir, err)
+		return exitFailed
+	}
+	defer watcher.Stop()
+
+	//3. construct the server
+	server := iserver.NewInceptionServer(port, registry)
+	server.SetImages(images)
+	server.SetLabelIndex(labels)
+	server.SetCache(cache)
+	server.SetStore(st)
+	server.SetVersion(version)
+	server.SetShutdownDelay(shutdownDelay)
+	server.SetRequestTimeout(requestTimeout)
+	server.EnableReloadAPI(reloadAPI)
+	server.SetConcurrencyLimit(maxInflight, maxQueue, maxQueueWait)
+	server.Print()
+	go func() {
+		if err := server.WarmUp(); err != nil {
+			glog.Errorf("Server is not ready: %v", err)
+		}
+	}()
+	if err := serveUntilSignal(server); err != nil {
+		glog.Errorf("Server failed: %v", err)
+		return exitFailed
+	}
+
+	// the deferred calls stop the watcher and the label index, close the store, and then the models
+	glog.V(1).Infof("Server is stopped.")
+	return exitOK
+}
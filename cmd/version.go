@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	tf "github.com/tensorflow/tensorflow/tensorflow/go"
+)
+
+// set by the build, e.g. go build -ldflags "-X main.version=v1.0"
+var version = "dev"
+
+// runVersion prints the versions of the binary, go and tensorflow.
+func runVersion(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "version takes no arguments")
+		return exitUsage
+	}
+
+	fmt.Printf("inceptions %v\n", version)
+	fmt.Printf("go %v %v/%v\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Printf("tensorflow %v\n", tf.Version())
+	return exitOK
+}
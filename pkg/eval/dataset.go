@@ -0,0 +1,167 @@
+package eval
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	tfmodel "inceptionServer/pkg/model"
+)
+
+// Sample is a labeled image of a dataset.
+type Sample struct {
+	Path  string `json:"path"`
+	Label string `json:"label"`
+}
+
+/*
+ LoadDataset reads the labeled images, either from a dir with a sub dir of images for each class,
+ or from a manifest of path,label: a .csv file, or a .jsonl file of {"path": ..., "label": ...}.
+ The relative paths of a manifest are relative to the dir of the manifest.
+*/
+func LoadDataset(path string) ([]*Sample, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []*Sample
+	switch {
+	case info.IsDir():
+		samples, err = loadClassDirs(path)
+	case strings.ToLower(filepath.Ext(path)) == ".csv":
+		samples, err = loadManifest(path, readCSV)
+	case strings.ToLower(filepath.Ext(path)) == ".jsonl":
+		samples, err = loadManifest(path, readJSONL)
+	default:
+		return nil, fmt.Errorf("dataset %v should be a dir, a .csv or a .jsonl file", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(samples) < 1 {
+		return nil, fmt.Errorf("no image in dataset %v", path)
+	}
+	return samples, nil
+}
+
+// the images of each sub dir are labeled by the name of the sub dir
+func loadClassDirs(dir string) ([]*Sample, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := []*Sample{}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		label := entry.Name()
+		err := filepath.Walk(filepath.Join(dir, label), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && tfmodel.IsImageFile(path) {
+				samples = append(samples, &Sample{Path: path, Label: label})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to walk %v: %v", label, err)
+		}
+	}
+	return samples, nil
+}
+
+func loadManifest(fname string, read func(io.Reader) ([]*Sample, error)) ([]*Sample, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	samples, err := read(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %v: %v", fname, err)
+	}
+
+	dir := filepath.Dir(fname)
+	for _, s := range samples {
+		if !filepath.IsAbs(s.Path) {
+			s.Path = filepath.Join(dir, s.Path)
+		}
+	}
+	return samples, nil
+}
+
+// path,label rows; the first row is skipped if it is the header
+func readCSV(r io.Reader) ([]*Sample, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	samples := []*Sample{}
+	for line := 1; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(row) < 2 {
+			return nil, fmt.Errorf("line %d: path,label is expected", line)
+		}
+		if line == 1 && strings.ToLower(row[0]) == "path" && strings.ToLower(row[1]) == "label" {
+			continue
+		}
+		samples = append(samples, &Sample{Path: row[0], Label: row[1]})
+	}
+	return samples, nil
+}
+
+func readJSONL(r io.Reader) ([]*Sample, error) {
+	samples := []*Sample{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		s := &Sample{}
+		if err := json.Unmarshal([]byte(text), s); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if s.Path == "" || s.Label == "" {
+			return nil, fmt.Errorf("line %d: path and label are expected", line)
+		}
+		samples = append(samples, s)
+	}
+	return samples, scanner.Err()
+}
+
+// Classes returns the sorted labels of the samples.
+func Classes(samples []*Sample) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, s := range samples {
+		if !seen[s.Label] {
+			seen[s.Label] = true
+			result = append(result, s.Label)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,95 @@
+package eval
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+/*
+ LabelMap maps the labels predicted by a model onto the classes of a dataset.
+ A class is matched by the model labels given in the alias file, or else by the
+ model label of the same name; names are compared case-insensitively, and '_'
+ is the same as a space, e.g., the dir "tiger_cat" is the label "tiger cat".
+*/
+type LabelMap struct {
+	// normalized model label -> class
+	classes map[string]string
+	// the classes which match no model label
+	unmapped []string
+}
+
+/*
+ LoadAliases reads an alias file: a json object from the classes of the dataset
+ to the lists of model labels, for example:
+   {"cat": ["tabby", "tiger cat", "Persian cat"], "car": ["sports car", "convertible"]}
+*/
+func LoadAliases(fname string) (map[string][]string, error) {
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := make(map[string][]string)
+	if err := json.Unmarshal(content, &aliases); err != nil {
+		return nil, fmt.Errorf("failed to parse alias file %v: %v", fname, err)
+	}
+	return aliases, nil
+}
+
+func normalize(label string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Replace(label, "_", " ", -1)))
+}
+
+// NewLabelMap maps the model labels onto the classes; aliases may be nil.
+func NewLabelMap(classes, modelLabels []string, aliases map[string][]string) (*LabelMap, error) {
+	known := make(map[string]bool, len(modelLabels))
+	for _, label := range modelLabels {
+		known[normalize(label)] = true
+	}
+
+	m := &LabelMap{
+		classes:  make(map[string]string),
+		unmapped: []string{},
+	}
+	for _, class := range classes {
+		labels, exist := aliases[class]
+		if !exist {
+			labels = []string{class}
+		}
+
+		mapped := false
+		for _, label := range labels {
+			label = normalize(label)
+			if !known[label] {
+				if exist {
+					return nil, fmt.Errorf("alias %q of class %v is not a label of the model", label, class)
+				}
+				continue
+			}
+			if other, dup := m.classes[label]; dup {
+				return nil, fmt.Errorf("model label %q is mapped to both class %v and %v", label, other, class)
+			}
+			m.classes[label] = class
+			mapped = true
+		}
+		if !mapped {
+			m.unmapped = append(m.unmapped, class)
+		}
+	}
+
+	sort.Strings(m.unmapped)
+	return m, nil
+}
+
+// Class returns the class of the model label; "" if it is none of the classes.
+func (m *LabelMap) Class(modelLabel string) string {
+	return m.classes[normalize(modelLabel)]
+}
+
+// Unmapped returns the classes which match no model label; their images are never predicted right.
+func (m *LabelMap) Unmapped() []string {
+	return m.unmapped
+}
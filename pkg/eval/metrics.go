@@ -0,0 +1,228 @@
+package eval
+
+import (
+	"math"
+
+	tfmodel "inceptionServer/pkg/model"
+)
+
+const (
+	// column of the confusion matrix for the predictions which are none of the classes
+	OtherClass = "(other)"
+
+	// the predictions are right if the class is in the top TopK labels
+	TopK = 5
+
+	// number of equal-width confidence bins of the calibration error
+	calibrationBins = 10
+)
+
+// ClassMetrics are the metrics of the top-1 predictions of a class.
+type ClassMetrics struct {
+	Class string `json:"class"`
+	// number of images of the class
+	Support int `json:"support"`
+	// number of images predicted as the class
+	Predicted int `json:"predicted"`
+	Correct   int `json:"correct"`
+	// 0 if there is no image predicted as the class
+	Precision float64 `json:"precision"`
+	Recall    float64 `json:"recall"`
+	F1        float64 `json:"f1"`
+}
+
+// CalibrationBin compares the confidence of the top-1 predictions with their accuracy.
+type CalibrationBin struct {
+	// range of the confidence
+	Min        float64 `json:"min"`
+	Max        float64 `json:"max"`
+	Count      int     `json:"count"`
+	Confidence float64 `json:"confidence"`
+	Accuracy   float64 `json:"accuracy"`
+}
+
+// Failure is an image which failed to be predicted.
+type Failure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// Report is the result of an evaluation.
+type Report struct {
+	Model   string `json:"model"`
+	Version string `json:"version"`
+	Dataset string `json:"dataset"`
+
+	Images    int `json:"images"`
+	Evaluated int `json:"evaluated"`
+	Failed    int `json:"failed"`
+
+	Top1Accuracy float64 `json:"top1_accuracy"`
+	Top5Accuracy float64 `json:"top5_accuracy"`
+	// expected calibration error of the top-1 predictions
+	CalibrationError float64           `json:"calibration_error"`
+	Calibration      []*CalibrationBin `json:"calibration"`
+
+	Classes []*ClassMetrics `json:"classes"`
+	// the classes which match no model label
+	Unmapped []string `json:"unmapped"`
+	// Confusion[i][j] is the number of images of Classes[i] predicted as Labels[j];
+	// the last label is OtherClass
+	ConfusionLabels []string `json:"confusion_labels"`
+	Confusion       [][]int  `json:"confusion"`
+
+	Failures  []*Failure `json:"failures"`
+	ElapsedMs float64    `json:"elapsed_ms"`
+}
+
+/*
+ Evaluator accumulates the predictions of the images of a dataset.
+ It is not safe for concurrent use.
+*/
+type Evaluator struct {
+	labels  *LabelMap
+	classes []string
+	// index of each class in classes
+	index map[string]int
+
+	images    int
+	evaluated int
+	top1      int
+	top5      int
+	confusion [][]int
+	bins      []calibrationSum
+	failures  []*Failure
+}
+
+type calibrationSum struct {
+	count      int
+	confidence float64
+	correct    int
+}
+
+// NewEvaluator evaluates the predictions of the images of the classes.
+func NewEvaluator(classes []string, labels *LabelMap) *Evaluator {
+	e := &Evaluator{
+		labels:    labels,
+		classes:   classes,
+		index:     make(map[string]int, len(classes)),
+		confusion: make([][]int, len(classes)),
+		bins:      make([]calibrationSum, calibrationBins),
+		failures:  []*Failure{},
+	}
+	for i, class := range classes {
+		e.index[class] = i
+		// the last column is OtherClass
+		e.confusion[i] = make([]int, len(classes)+1)
+	}
+	return e
+}
+
+// Add the top-k predicted labels of the sample, the most confident first.
+func (e *Evaluator) Add(s *Sample, labels []*tfmodel.LabelWeight) {
+	actual, ok := e.index[s.Label]
+	if !ok {
+		e.AddFailure(s, "unknown class "+s.Label)
+		return
+	}
+	if len(labels) < 1 {
+		e.AddFailure(s, "no label is predicted")
+		return
+	}
+	e.images++
+	e.evaluated++
+
+	predicted := len(e.classes)
+	if i, ok := e.index[e.labels.Class(labels[0].Label)]; ok {
+		predicted = i
+	}
+	e.confusion[actual][predicted]++
+
+	correct := predicted == actual
+	if correct {
+		e.top1++
+	}
+	for i := 0; i < len(labels) && i < TopK; i++ {
+		if e.labels.Class(labels[i].Label) == s.Label {
+			e.top5++
+			break
+		}
+	}
+
+	confidence := float64(labels[0].Weight)
+	bin := int(confidence * calibrationBins)
+	if bin >= calibrationBins {
+		bin = calibrationBins - 1
+	}
+	if bin < 0 {
+		bin = 0
+	}
+	e.bins[bin].count++
+	e.bins[bin].confidence += confidence
+	if correct {
+		e.bins[bin].correct++
+	}
+}
+
+// AddFailure records an image which failed to be predicted.
+func (e *Evaluator) AddFailure(s *Sample, err string) {
+	e.images++
+	e.failures = append(e.failures, &Failure{Path: s.Path, Error: err})
+}
+
+func ratio(a, b int) float64 {
+	if b < 1 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+// Report computes the metrics of the predictions added so far.
+func (e *Evaluator) Report() *Report {
+	r := &Report{
+		Images:          e.images,
+		Evaluated:       e.evaluated,
+		Failed:          len(e.failures),
+		Top1Accuracy:    ratio(e.top1, e.evaluated),
+		Top5Accuracy:    ratio(e.top5, e.evaluated),
+		Classes:         make([]*ClassMetrics, 0, len(e.classes)),
+		Unmapped:        e.labels.Unmapped(),
+		ConfusionLabels: append(append([]string{}, e.classes...), OtherClass),
+		Confusion:       e.confusion,
+		Failures:        e.failures,
+	}
+
+	for i, class := range e.classes {
+		m := &ClassMetrics{Class: class}
+		for j := range e.classes {
+			m.Predicted += e.confusion[j][i]
+		}
+		for _, n := range e.confusion[i] {
+			m.Support += n
+		}
+		m.Correct = e.confusion[i][i]
+		m.Precision = ratio(m.Correct, m.Predicted)
+		m.Recall = ratio(m.Correct, m.Support)
+		if m.Precision+m.Recall > 0 {
+			m.F1 = 2 * m.Precision * m.Recall / (m.Precision + m.Recall)
+		}
+		r.Classes = append(r.Classes, m)
+	}
+
+	r.Calibration = make([]*CalibrationBin, 0, calibrationBins)
+	for i, sum := range e.bins {
+		bin := &CalibrationBin{
+			Min:   float64(i) / calibrationBins,
+			Max:   float64(i+1) / calibrationBins,
+			Count: sum.count,
+		}
+		if sum.count > 0 {
+			bin.Confidence = sum.confidence / float64(sum.count)
+			bin.Accuracy = ratio(sum.correct, sum.count)
+			r.CalibrationError += ratio(sum.count, e.evaluated) * math.Abs(bin.Accuracy-bin.Confidence)
+		}
+		r.Calibration = append(r.Calibration, bin)
+	}
+
+	return r
+}
@@ -0,0 +1,143 @@
+package eval
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	tfmodel "inceptionServer/pkg/model"
+)
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestNewLabelMap(t *testing.T) {
+	modelLabels := []string{"tabby cat", "tiger cat", "beagle", "sports_car", "Dog"}
+
+	tests := []struct {
+		name    string
+		classes []string
+		aliases map[string][]string
+		// model label -> class
+		classOf  map[string]string
+		unmapped []string
+		err      bool
+	}{
+		{
+			name:     "by name",
+			classes:  []string{"dog", "sports car", "bird"},
+			classOf:  map[string]string{"Dog": "dog", "sports_car": "sports car", "beagle": "", "bird": ""},
+			unmapped: []string{"bird"},
+		},
+		{
+			name:     "by alias",
+			classes:  []string{"cat", "dog"},
+			aliases:  map[string][]string{"cat": {"tabby cat", "Tiger_cat"}, "dog": {"beagle", "dog"}},
+			classOf:  map[string]string{"tabby cat": "cat", "tiger cat": "cat", "beagle": "dog", "Dog": "dog"},
+			unmapped: []string{},
+		},
+		{
+			name:    "unknown alias",
+			classes: []string{"cat"},
+			aliases: map[string][]string{"cat": {"persian cat"}},
+			err:     true,
+		},
+		{
+			name:    "duplicate alias",
+			classes: []string{"cat", "tiger"},
+			aliases: map[string][]string{"cat": {"tiger cat"}, "tiger": {"tiger cat"}},
+			err:     true,
+		},
+	}
+
+	for _, test := range tests {
+		m, err := NewLabelMap(test.classes, modelLabels, test.aliases)
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: got no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+
+		for label, class := range test.classOf {
+			if got := m.Class(label); got != class {
+				t.Errorf("%v: got class %q of %q, want %q", test.name, got, label, class)
+			}
+		}
+		if !reflect.DeepEqual(m.Unmapped(), test.unmapped) {
+			t.Errorf("%v: got unmapped %v, want %v", test.name, m.Unmapped(), test.unmapped)
+		}
+	}
+}
+
+func TestEvaluator(t *testing.T) {
+	classes := []string{"cat", "dog"}
+	aliases := map[string][]string{"cat": {"tabby cat", "tiger cat"}, "dog": {"beagle"}}
+	labels, err := NewLabelMap(classes, []string{"tabby cat", "tiger cat", "beagle", "sports car"}, aliases)
+	if err != nil {
+		t.Fatalf("failed to map labels: %v", err)
+	}
+
+	e := NewEvaluator(classes, labels)
+	lw := tfmodel.NewLabelWeight
+	// right
+	e.Add(&Sample{Path: "1", Label: "cat"}, []*tfmodel.LabelWeight{lw("tabby cat", 0.95), lw("beagle", 0.01)})
+	// wrong, but right in the top 5
+	e.Add(&Sample{Path: "2", Label: "cat"}, []*tfmodel.LabelWeight{lw("beagle", 0.65), lw("tiger cat", 0.2)})
+	// right
+	e.Add(&Sample{Path: "3", Label: "dog"}, []*tfmodel.LabelWeight{lw("beagle", 0.85)})
+	// none of the classes, but right in the top 5
+	e.Add(&Sample{Path: "4", Label: "dog"}, []*tfmodel.LabelWeight{lw("sports car", 0.45), lw("beagle", 0.3)})
+	// wrong
+	e.Add(&Sample{Path: "5", Label: "dog"}, []*tfmodel.LabelWeight{lw("tabby cat", 0.55)})
+	e.Add(&Sample{Path: "6", Label: "cat"}, []*tfmodel.LabelWeight{})
+	e.Add(&Sample{Path: "7", Label: "bird"}, []*tfmodel.LabelWeight{lw("beagle", 0.9)})
+	e.AddFailure(&Sample{Path: "8", Label: "cat"}, "failed to decode")
+
+	r := e.Report()
+	if r.Images != 8 || r.Evaluated != 5 || r.Failed != 3 || len(r.Failures) != 3 {
+		t.Errorf("got %d images, %d evaluated, %d failed", r.Images, r.Evaluated, r.Failed)
+	}
+	if !almostEqual(r.Top1Accuracy, 0.4) {
+		t.Errorf("got top-1 accuracy %v, want 0.4", r.Top1Accuracy)
+	}
+	if !almostEqual(r.Top5Accuracy, 0.8) {
+		t.Errorf("got top-5 accuracy %v, want 0.8", r.Top5Accuracy)
+	}
+
+	if want := []string{"cat", "dog", OtherClass}; !reflect.DeepEqual(r.ConfusionLabels, want) {
+		t.Errorf("got confusion labels %v, want %v", r.ConfusionLabels, want)
+	}
+	if want := [][]int{{1, 1, 0}, {1, 1, 1}}; !reflect.DeepEqual(r.Confusion, want) {
+		t.Errorf("got confusion %v, want %v", r.Confusion, want)
+	}
+
+	tests := []struct {
+		class                       string
+		support, predicted, correct int
+		precision, recall, f1       float64
+	}{
+		{"cat", 2, 2, 1, 0.5, 0.5, 0.5},
+		{"dog", 3, 2, 1, 0.5, 1.0 / 3, 0.4},
+	}
+	for i, test := range tests {
+		m := r.Classes[i]
+		if m.Class != test.class || m.Support != test.support || m.Predicted != test.predicted || m.Correct != test.correct {
+			t.Errorf("%v: got %+v", test.class, m)
+		}
+		if !almostEqual(m.Precision, test.precision) || !almostEqual(m.Recall, test.recall) || !almostEqual(m.F1, test.f1) {
+			t.Errorf("%v: got precision %v, recall %v, f1 %v, want %v, %v, %v",
+				test.class, m.Precision, m.Recall, m.F1, test.precision, test.recall, test.f1)
+		}
+	}
+
+	// one image in each bin: |1 - 0.95| + |0 - 0.65| + |1 - 0.85| + |0 - 0.45| + |0 - 0.55|
+	if !almostEqual(r.CalibrationError, 1.85/5) {
+		t.Errorf("got calibration error %v, want %v", r.CalibrationError, 1.85/5)
+	}
+}
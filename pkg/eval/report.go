@@ -0,0 +1,122 @@
+package eval
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// the confusion matrix is not printed to the terminal if there are more classes
+const maxTextConfusionClasses = 20
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": func(v float64) string { return fmt.Sprintf("%.2f%%", v*100) },
+	"ratio":   func(v float64) string { return fmt.Sprintf("%.4f", v) },
+}).Parse(`<html><head><title>Evaluation of {{.Model}}</title>
+<style>
+ table { border-collapse: collapse; }
+ td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: right; }
+ th { background: #eee; }
+ td.name { text-align: left; }
+ td.hit { background: #cfc; }
+</style>
+</head><body>
+<h1>Evaluation of {{.Model}}</h1>
+<table>
+ <tr><td class="name">model version</td><td>{{.Version}}</td></tr>
+ <tr><td class="name">dataset</td><td>{{.Dataset}}</td></tr>
+ <tr><td class="name">images</td><td>{{.Images}} ({{.Failed}} failed)</td></tr>
+ <tr><td class="name">top-1 accuracy</td><td>{{percent .Top1Accuracy}}</td></tr>
+ <tr><td class="name">top-5 accuracy</td><td>{{percent .Top5Accuracy}}</td></tr>
+ <tr><td class="name">calibration error</td><td>{{ratio .CalibrationError}}</td></tr>
+</table>
+{{if .Unmapped}}<p>Classes matching no label of the model: {{range .Unmapped}}{{.}} {{end}}</p>{{end}}
+
+<h2>Classes</h2>
+<table>
+ <tr><th>class</th><th>support</th><th>predicted</th><th>precision</th><th>recall</th><th>f1</th></tr>
+ {{range .Classes}}<tr><td class="name">{{.Class}}</td><td>{{.Support}}</td><td>{{.Predicted}}</td>
+ <td>{{ratio .Precision}}</td><td>{{ratio .Recall}}</td><td>{{ratio .F1}}</td></tr>
+ {{end}}
+</table>
+
+<h2>Confusion matrix</h2>
+<p>Rows are the classes of the images, columns are the predicted classes.</p>
+<table>
+ <tr><th></th>{{range .ConfusionLabels}}<th>{{.}}</th>{{end}}</tr>
+ {{range $i, $row := .Confusion}}<tr><th>{{index $.ConfusionLabels $i}}</th>
+ {{range $j, $n := $row}}<td{{if eq $i $j}} class="hit"{{end}}>{{$n}}</td>{{end}}</tr>
+ {{end}}
+</table>
+
+<h2>Calibration</h2>
+<table>
+ <tr><th>confidence</th><th>images</th><th>mean confidence</th><th>accuracy</th></tr>
+ {{range .Calibration}}<tr><td>{{printf "%.1f-%.1f" .Min .Max}}</td><td>{{.Count}}</td>
+ <td>{{ratio .Confidence}}</td><td>{{ratio .Accuracy}}</td></tr>
+ {{end}}
+</table>
+
+{{if .Failures}}<h2>Failures</h2>
+<table>
+ {{range .Failures}}<tr><td class="name">{{.Path}}</td><td class="name">{{.Error}}</td></tr>
+ {{end}}
+</table>{{end}}
+</body></html>
+`))
+
+func (r *Report) WriteJSON(w io.Writer) error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(content, '\n'))
+	return err
+}
+
+func (r *Report) WriteHTML(w io.Writer) error {
+	return reportTemplate.Execute(w, r)
+}
+
+// WriteText writes the summary, the metrics of the classes and the confusion matrix for the terminal.
+func (r *Report) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "model:              %v (version %v)\n", r.Model, r.Version)
+	fmt.Fprintf(w, "dataset:            %v\n", r.Dataset)
+	fmt.Fprintf(w, "images:             %d evaluated, %d failed, in %.1fs\n", r.Evaluated, r.Failed, r.ElapsedMs/1000)
+	fmt.Fprintf(w, "top-1 accuracy:     %.2f%%\n", r.Top1Accuracy*100)
+	fmt.Fprintf(w, "top-5 accuracy:     %.2f%%\n", r.Top5Accuracy*100)
+	fmt.Fprintf(w, "calibration error:  %.4f\n", r.CalibrationError)
+	if len(r.Unmapped) > 0 {
+		fmt.Fprintf(w, "unmapped classes:   %v\n", strings.Join(r.Unmapped, ", "))
+	}
+
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "CLASS\tSUPPORT\tPREDICTED\tPRECISION\tRECALL\tF1\t\n")
+	for _, m := range r.Classes {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.4f\t%.4f\t%.4f\t\n", m.Class, m.Support, m.Predicted, m.Precision, m.Recall, m.F1)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	if len(r.Classes) > maxTextConfusionClasses {
+		fmt.Fprintf(w, "confusion matrix of %d classes is only in the reports\n", len(r.Classes))
+		return nil
+	}
+	fmt.Fprintln(w, "confusion matrix (rows: actual, columns: predicted):")
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "\t%s\t\n", strings.Join(r.ConfusionLabels, "\t"))
+	for i, row := range r.Confusion {
+		cells := make([]string, len(row))
+		for j, n := range row {
+			cells[j] = fmt.Sprint(n)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t\n", r.ConfusionLabels[i], strings.Join(cells, "\t"))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,238 @@
+package model
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// estimated memory of a cached result besides its labels
+const cacheEntryOverhead = 128
+
+/*
+ PredictCache is an LRU cache of the prediction results, bounded by the number of
+ entries and their estimated size in bytes. A result is keyed by the content hash
+ of the image, the model and its version, and k; so the results of a reloaded model
+ are never returned, and they are dropped by RemoveModel.
+ If a Store is set, it is the second level of the cache, which survives restarts.
+ It is safe for concurrent use.
+*/
+type PredictCache struct {
+	lock sync.Mutex
+	// nil if the LRU cache is disabled
+	lru *lruCache
+
+	store Store
+
+	// number of lookups by result, since the start
+	hits, storeHits, misses int64
+}
+
+// CacheStats is a snapshot of the state of a PredictCache.
+type CacheStats struct {
+	Enabled    bool  `json:"enabled"`
+	Entries    int   `json:"entries"`
+	MaxEntries int   `json:"max_entries"`
+	Bytes      int64 `json:"bytes"`
+	MaxBytes   int64 `json:"max_bytes"`
+	Hits       int64 `json:"hits"`
+	StoreHits  int64 `json:"store_hits"`
+	Misses     int64 `json:"misses"`
+}
+
+type cacheKey struct {
+	image   string
+	model   string
+	version int64
+	k       int
+}
+
+// NewPredictCache disables the LRU cache if either bound is not positive.
+func NewPredictCache(maxEntries int, maxBytes int64) *PredictCache {
+	if maxEntries < 1 || maxBytes < 1 {
+		return &PredictCache{}
+	}
+
+	return &PredictCache{
+		lru: newLRUCache(maxEntries, maxBytes, func(key interface{}) {
+			cacheEvictions.WithLabelValues(key.(cacheKey).model).Inc()
+		}),
+	}
+}
+
+// SetStore sets the store to read the results missed by the LRU cache from, and to save the new results in.
+func (c *PredictCache) SetStore(store Store) {
+	c.store = store
+}
+
+func newCacheKey(imageID string, info *ModelInfo, k int) cacheKey {
+	return cacheKey{
+		image:   imageID,
+		model:   info.ID,
+		version: info.LoadedAt.UnixNano(),
+		k:       k,
+	}
+}
+
+func resultSize(key cacheKey, result *PredictResult) int64 {
+	size := int64(cacheEntryOverhead + len(key.image) + len(key.model) + len(result.Model))
+	for _, lw := range result.Labels {
+		size += int64(len(lw.Label) + 32)
+	}
+	return size
+}
+
+/*
+ PredictTopK returns the cached result of the image, or predicts it with predict;
+ the cache is not read if bypass is set, but the new result is still cached.
+ hit tells whether the result is from the cache; then its PredictMs is 0. The current version of the model
+ is pinned, and passed to predict, so that the result is cached under its version
+ even if the model is reloaded meanwhile.
+*/
+func (c *PredictCache) PredictTopK(imageID string, model Classifier, k int, bypass bool,
+	predict func(model Classifier) (*PredictResult, error)) (result *PredictResult, hit bool, err error) {
+	model, release := pin(model)
+	defer release()
+	if c == nil {
+		result, err = predict(model)
+		return result, false, err
+	}
+
+	info := model.Info()
+	key := newCacheKey(imageID, info, k)
+	if !bypass {
+		if result, ok := c.get(key); ok {
+			cacheRequests.WithLabelValues(info.ID, "hit").Inc()
+			atomic.AddInt64(&c.hits, 1)
+			return cached(result), true, nil
+		}
+
+		if result := c.load(imageID, info, k); result != nil {
+			cacheRequests.WithLabelValues(info.ID, "store").Inc()
+			atomic.AddInt64(&c.storeHits, 1)
+			c.add(key, result)
+			return cached(result), true, nil
+		}
+	}
+	cacheRequests.WithLabelValues(info.ID, "miss").Inc()
+	atomic.AddInt64(&c.misses, 1)
+
+	result, err = predict(model)
+	if err != nil {
+		return nil, false, err
+	}
+	c.add(key, result)
+	c.save(imageID, info, k, result)
+	return result, false, nil
+}
+
+// cached returns a copy of the cached result, which took no time to predict.
+func cached(result *PredictResult) *PredictResult {
+	copied := *result
+	copied.PredictMs = 0
+	return &copied
+}
+
+// load the result from the store; returns nil if it is not stored.
+func (c *PredictCache) load(imageID string, info *ModelInfo, k int) *PredictResult {
+	if c.store == nil || info.Version == "" {
+		return nil
+	}
+
+	result, err := c.store.GetPrediction(imageID, info.Version, k)
+	if err != nil {
+		glog.Errorf("Failed to get prediction of image %v from store: %v", imageID, err)
+		return nil
+	}
+	return result
+}
+
+func (c *PredictCache) save(imageID string, info *ModelInfo, k int, result *PredictResult) {
+	if c.store == nil || info.Version == "" {
+		return
+	}
+
+	if err := c.store.SavePrediction(imageID, info.Version, k, result); err != nil {
+		glog.Errorf("Failed to save prediction of image %v in store: %v", imageID, err)
+	}
+}
+
+func (c *PredictCache) get(key cacheKey) (*PredictResult, bool) {
+	if c.lru == nil {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	value, exist := c.lru.get(key)
+	if !exist {
+		return nil, false
+	}
+	return value.(*PredictResult), true
+}
+
+func (c *PredictCache) add(key cacheKey, result *PredictResult) {
+	if c.lru == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lru.add(key, result, resultSize(key, result))
+	c.updateGauges()
+}
+
+// RemoveModel drops the results of all the versions of the model, e.g., after it is reloaded.
+func (c *PredictCache) RemoveModel(model string) {
+	if c == nil || c.lru == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lru.removeIf(func(key interface{}) bool {
+		return key.(cacheKey).model == model
+	})
+	c.updateGauges()
+}
+
+func (c *PredictCache) updateGauges() {
+	cacheEntries.Set(float64(c.lru.len()))
+	cacheBytes.Set(float64(c.lru.bytes))
+}
+
+// Stats returns the size and the lookups of the cache; a nil cache is disabled.
+func (c *PredictCache) Stats() *CacheStats {
+	if c == nil {
+		return &CacheStats{}
+	}
+
+	stats := &CacheStats{
+		Enabled:   c.lru != nil,
+		Hits:      atomic.LoadInt64(&c.hits),
+		StoreHits: atomic.LoadInt64(&c.storeHits),
+		Misses:    atomic.LoadInt64(&c.misses),
+	}
+	if c.lru != nil {
+		c.lock.Lock()
+		stats.Entries, stats.MaxEntries = c.lru.len(), c.lru.maxEntries
+		stats.Bytes, stats.MaxBytes = c.lru.bytes, c.lru.maxBytes
+		c.lock.Unlock()
+	}
+	return stats
+}
+
+func (c *PredictCache) String() string {
+	if c == nil || c.lru == nil {
+		return "disabled"
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return fmt.Sprintf("%d/%d entries, %d/%d bytes", c.lru.len(), c.lru.maxEntries, c.lru.bytes, c.lru.maxBytes)
+}
@@ -0,0 +1,62 @@
+package model
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Input is a preprocessed image, as returned by Classifier.Preprocess;
+// it can only be consumed by the Classifier that produced it.
+type Input interface{}
+
+/*
+ Classifier assigns labels to images; tfgraph.TfModel and FakeClassifier implement it.
+ The work is skipped if ctx is done before it starts, and an Error of KindTimeout
+ or KindCanceled is returned.
+*/
+type Classifier interface {
+	// PredictTopK returns the top-k labels of the encoded image
+	PredictTopK(ctx context.Context, bytes []byte, k int) (*PredictResult, error)
+
+	// Preprocess converts the encoded image into the input of the Classifier
+	Preprocess(ctx context.Context, bytes []byte) (Input, error)
+
+	// PredictTopKInput returns the top-k labels of a preprocessed image
+	PredictTopKInput(ctx context.Context, input Input, k int) (*PredictResult, error)
+
+	GetLabels() []string
+	Info() *ModelInfo
+	Close() error
+}
+
+var _ Classifier = &FakeClassifier{}
+
+type ModelInfo struct {
+	ID        string `json:"id"`
+	ModelDir  string `json:"model_dir"`
+	NumLabels int    `json:"num_labels"`
+	// [Height, Width, Channels]
+	InputShape []int `json:"input_shape"`
+	// empty if the model has no embedding
+	EmbeddingOp string `json:"embedding_op,omitempty"`
+	Checksum    string `json:"checksum"`
+	// identifies the results of the model: it is changed if the graph, the labels or the preprocessing is changed
+	Version  string    `json:"version"`
+	LoadedAt time.Time `json:"loaded_at"`
+	LoadMs   float64   `json:"load_ms"`
+}
+
+// VersionOf returns the hex encoded prefix of the digest of the model
+func VersionOf(checksum string, config *ModelConfig, labels []string) string {
+	h := sha256.New()
+	h.Write([]byte(checksum))
+	if content, err := json.Marshal(config); err == nil {
+		h.Write(content)
+	}
+	h.Write([]byte(strings.Join(labels, "\n")))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
@@ -0,0 +1,146 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// name of the manifest file in the model dir
+	ModelConfigFile = "model.json"
+
+	ResizeBilinear   = "bilinear"
+	ResizeArea       = "area"
+	ResizeCenterCrop = "center-crop"
+
+	ChannelRGB = "RGB"
+	ChannelBGR = "BGR"
+)
+
+/*
+ ModelConfig describes how to feed images to a frozen graph; it is read from
+ the model.json in the model dir. The fields not set in the manifest keep the
+ values for the inception5h model, except download_url and embedding_op, which
+ are empty: another model is neither downloaded from, nor embedded like inception5h.
+*/
+type ModelConfig struct {
+	ModelFile string `json:"model_file"`
+	LabelFile string `json:"label_file"`
+	// if set, the model is downloaded (a zip archive) when the files are missing
+	DownloadURL string `json:"download_url"`
+
+	InputOp  string `json:"input_op"`
+	OutputOp string `json:"output_op"`
+	// the intermediate operation whose output is used as the feature vector of an image;
+	// embedding is disabled if it is empty, or not found in the graph.
+	EmbeddingOp string `json:"embedding_op"`
+
+	// size of the input image
+	Height int `json:"height"`
+	Width  int `json:"width"`
+
+	// pixels are normalized as (value - Mean)/Std;
+	// one value for all the channels, or one value for each channel.
+	Mean []float32 `json:"mean"`
+	Std  []float32 `json:"std"`
+
+	ChannelOrder string `json:"channel_order"`
+	Resize       string `json:"resize"`
+	// fraction of the image kept by the center-crop resize method
+	CentralFraction float32 `json:"central_fraction"`
+}
+
+// DefaultModelConfig describes the pre-trained model at:
+// https://storage.googleapis.com/download.tensorflow.org/models/inception5h.zip
+func DefaultModelConfig() *ModelConfig {
+	return &ModelConfig{
+		ModelFile:       "tensorflow_inception_graph.pb",
+		LabelFile:       "imagenet_comp_graph_label_strings.txt",
+		DownloadURL:     "https://storage.googleapis.com/download.tensorflow.org/models/inception5h.zip",
+		InputOp:         "input",
+		OutputOp:        "output",
+		EmbeddingOp:     "avgpool0",
+		Height:          224,
+		Width:           224,
+		Mean:            []float32{117},
+		Std:             []float32{1},
+		ChannelOrder:    ChannelRGB,
+		Resize:          ResizeBilinear,
+		CentralFraction: 0.875,
+	}
+}
+
+// LoadModelConfig reads the manifest in the dir; returns the default config if there is no manifest.
+func LoadModelConfig(dir string) (*ModelConfig, error) {
+	config := DefaultModelConfig()
+
+	fname := filepath.Join(dir, ModelConfigFile)
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			glog.V(2).Infof("No %v in %v, use the config of inception5h.", ModelConfigFile, dir)
+			return config, nil
+		}
+		return nil, err
+	}
+
+	config.DownloadURL = ""
+	config.EmbeddingOp = ""
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v", fname, err)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config in %v: %v", fname, err)
+	}
+	return config, nil
+}
+
+func (c *ModelConfig) Validate() error {
+	if c.ModelFile == "" || c.LabelFile == "" {
+		return fmt.Errorf("model_file and label_file must be set")
+	}
+
+	if c.InputOp == "" || c.OutputOp == "" {
+		return fmt.Errorf("input_op and output_op must be set")
+	}
+
+	if c.Height < 1 || c.Width < 1 {
+		return fmt.Errorf("invalid input size: %dx%d", c.Height, c.Width)
+	}
+
+	if len(c.Mean) != 1 && len(c.Mean) != 3 {
+		return fmt.Errorf("mean should have 1 or 3 values, got %d", len(c.Mean))
+	}
+	if len(c.Std) != 1 && len(c.Std) != 3 {
+		return fmt.Errorf("std should have 1 or 3 values, got %d", len(c.Std))
+	}
+	for _, v := range c.Std {
+		if v == 0 {
+			return fmt.Errorf("std can not be 0")
+		}
+	}
+
+	c.ChannelOrder = strings.ToUpper(c.ChannelOrder)
+	if c.ChannelOrder != ChannelRGB && c.ChannelOrder != ChannelBGR {
+		return fmt.Errorf("unknown channel_order: %v", c.ChannelOrder)
+	}
+
+	switch c.Resize {
+	case ResizeBilinear, ResizeArea:
+	case ResizeCenterCrop:
+		if c.CentralFraction <= 0 || c.CentralFraction > 1 {
+			return fmt.Errorf("central_fraction should be in (0, 1], got %v", c.CentralFraction)
+		}
+	default:
+		return fmt.Errorf("unknown resize method: %v", c.Resize)
+	}
+
+	return nil
+}
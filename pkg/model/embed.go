@@ -0,0 +1,16 @@
+package model
+
+import (
+	"context"
+)
+
+var ErrNoEmbedding error = &Error{Kind: KindNotImplemented, Msg: "embedding is not supported by the model"}
+
+// Embedder returns the feature vector of an image, i.e., the output of an intermediate layer.
+type Embedder interface {
+	Embed(ctx context.Context, bytes []byte) ([]float32, error)
+	// EmbedInput returns the feature vector of a preprocessed image
+	EmbedInput(ctx context.Context, input Input) ([]float32, error)
+}
+
+var _ Embedder = &FakeClassifier{}
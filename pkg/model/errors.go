@@ -0,0 +1,71 @@
+package model
+
+import (
+	"context"
+	"fmt"
+)
+
+/*
+ ErrorKind classifies the errors of the package, so that the callers, e.g., the http server,
+ can tell a bad request from a failure of the server.
+*/
+type ErrorKind int
+
+const (
+	// a failure of the server, or an error of unknown kind
+	KindInternal ErrorKind = iota
+	// the input is invalid, e.g., an empty image
+	KindInvalid
+	KindNotFound
+	KindTooLarge
+	// e.g., the format of an image
+	KindUnsupported
+	// the model can not do it, e.g., embedding
+	KindNotImplemented
+	// for the time being, e.g., no image is loaded yet, or the model is closed
+	KindUnavailable
+	// the deadline of the context is exceeded
+	KindTimeout
+	// the context is canceled, e.g., the client is gone
+	KindCanceled
+)
+
+// Error is an error of a kind.
+type Error struct {
+	Kind ErrorKind
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// NewError formats the message as fmt.Errorf does.
+func NewError(kind ErrorKind, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Msg: fmt.Sprintf(format, args...)}
+}
+
+// KindOf returns the kind of the error; KindInternal if it is neither an Error nor an error of a context.
+func KindOf(err error) ErrorKind {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	switch err {
+	case context.DeadlineExceeded:
+		return KindTimeout
+	case context.Canceled:
+		return KindCanceled
+	}
+	return KindInternal
+}
+
+// ContextError returns an Error of KindTimeout or KindCanceled if ctx is done; nil otherwise.
+func ContextError(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return NewError(KindTimeout, "the request timed out")
+	}
+	return NewError(KindCanceled, "the request is canceled")
+}
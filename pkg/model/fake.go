@@ -0,0 +1,145 @@
+package model
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+/*
+ FakeClassifier is a deterministic Classifier which needs no tensorflow graph:
+ the probabilities of an image are derived from the SHA-256 digest of its bytes,
+ so the same image always gets the same labels.
+*/
+type FakeClassifier struct {
+	ID     string
+	Labels []string
+
+	loadedAt time.Time
+}
+
+const fakeEmbeddingDim = 64
+
+type fakeInput struct {
+	digest [sha256.Size]byte
+}
+
+// NewFakeClassifier uses labels "label-0" ... "label-9" if no labels are given.
+func NewFakeClassifier(labels []string) *FakeClassifier {
+	if len(labels) < 1 {
+		for i := 0; i < 10; i++ {
+			labels = append(labels, fmt.Sprintf("label-%d", i))
+		}
+	}
+
+	return &FakeClassifier{
+		ID:       "fake",
+		Labels:   labels,
+		loadedAt: time.Now(),
+	}
+}
+
+func (f *FakeClassifier) PredictTopK(ctx context.Context, bytes []byte, k int) (*PredictResult, error) {
+	input, err := f.Preprocess(ctx, bytes)
+	if err != nil {
+		return nil, err
+	}
+	return f.PredictTopKInput(ctx, input, k)
+}
+
+func (f *FakeClassifier) Preprocess(ctx context.Context, bytes []byte) (Input, error) {
+	if err := ContextError(ctx); err != nil {
+		return nil, err
+	}
+	if len(bytes) < 1 {
+		return nil, NewError(KindInvalid, "empty image")
+	}
+	return &fakeInput{digest: sha256.Sum256(bytes)}, nil
+}
+
+func (f *FakeClassifier) PredictTopKInput(ctx context.Context, input Input, k int) (*PredictResult, error) {
+	if err := ContextError(ctx); err != nil {
+		return nil, err
+	}
+	begin := time.Now()
+	in, ok := input.(*fakeInput)
+	if !ok {
+		return nil, fmt.Errorf("unexpected input type for model %v: %T", f.ID, input)
+	}
+
+	return TopK(f.ID, f.Labels, f.probabilities(in), k, begin)
+}
+
+// probabilities sum to 1, and are seeded by the digest of the image
+func (f *FakeClassifier) probabilities(in *fakeInput) []float32 {
+	seed := int64(binary.LittleEndian.Uint64(in.digest[:8]))
+	r := rand.New(rand.NewSource(seed))
+
+	result := make([]float32, len(f.Labels))
+	sum := float32(0)
+	for i := range result {
+		result[i] = r.Float32()
+		sum += result[i]
+	}
+	for i := range result {
+		result[i] /= sum
+	}
+	return result
+}
+
+// Embed returns a unit vector of fakeEmbeddingDim, seeded by the digest of the image
+func (f *FakeClassifier) Embed(ctx context.Context, bytes []byte) ([]float32, error) {
+	input, err := f.Preprocess(ctx, bytes)
+	if err != nil {
+		return nil, err
+	}
+	return f.EmbedInput(ctx, input)
+}
+
+func (f *FakeClassifier) EmbedInput(ctx context.Context, input Input) ([]float32, error) {
+	if err := ContextError(ctx); err != nil {
+		return nil, err
+	}
+	in, ok := input.(*fakeInput)
+	if !ok {
+		return nil, fmt.Errorf("unexpected input type for model %v: %T", f.ID, input)
+	}
+
+	seed := int64(binary.LittleEndian.Uint64(in.digest[8:16]))
+	r := rand.New(rand.NewSource(seed))
+
+	result := make([]float32, fakeEmbeddingDim)
+	norm := float64(0)
+	for i := range result {
+		result[i] = float32(r.NormFloat64())
+		norm += float64(result[i] * result[i])
+	}
+	norm = math.Sqrt(norm)
+	for i := range result {
+		result[i] = float32(float64(result[i]) / norm)
+	}
+	return result, nil
+}
+
+func (f *FakeClassifier) GetLabels() []string {
+	return f.Labels
+}
+
+func (f *FakeClassifier) Info() *ModelInfo {
+	return &ModelInfo{
+		ID:        f.ID,
+		NumLabels: len(f.Labels),
+		// the fake model embeds the images too
+		EmbeddingOp: "fake",
+		Version:     VersionOf(f.ID, nil, f.Labels),
+		LoadedAt:    f.loadedAt,
+	}
+}
+
+func (f *FakeClassifier) Close() error {
+	return nil
+}
@@ -0,0 +1,106 @@
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"path/filepath"
+	"strings"
+
+	// register the decoders for image.Decode
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatGIF  = "gif"
+	FormatBMP  = "bmp"
+	FormatWebP = "webp"
+)
+
+var (
+	ErrUnknownFormat error = &Error{Kind: KindUnsupported, Msg: "unknown image format"}
+
+	imageExts = map[string]bool{
+		".jpg":  true,
+		".jpeg": true,
+		".png":  true,
+		".gif":  true,
+		".bmp":  true,
+		".webp": true,
+	}
+)
+
+// IsImageFile checks the file name extension, case-insensitively
+func IsImageFile(fname string) bool {
+	return imageExts[strings.ToLower(filepath.Ext(fname))]
+}
+
+// DetectFormat detects the image format from the magic bytes; returns "" if unknown.
+func DetectFormat(img []byte) string {
+	switch {
+	case bytes.HasPrefix(img, []byte{0xFF, 0xD8, 0xFF}):
+		return FormatJPEG
+	case bytes.HasPrefix(img, []byte("\x89PNG\r\n\x1a\n")):
+		return FormatPNG
+	case bytes.HasPrefix(img, []byte("GIF87a")), bytes.HasPrefix(img, []byte("GIF89a")):
+		return FormatGIF
+	case isBMP(img):
+		return FormatBMP
+	case len(img) >= 12 && string(img[0:4]) == "RIFF" && string(img[8:12]) == "WEBP":
+		return FormatWebP
+	}
+	return ""
+}
+
+/*
+ isBMP checks the BITMAPFILEHEADER, since "BM" alone is a common prefix: the file size at 2,
+ and the offset of the pixels at 10, which follow the DIB header of 12 bytes at least.
+*/
+func isBMP(img []byte) bool {
+	if len(img) < 26 || !bytes.HasPrefix(img, []byte("BM")) {
+		return false
+	}
+
+	size := binary.LittleEndian.Uint32(img[2:6])
+	offset := binary.LittleEndian.Uint32(img[10:14])
+	dibSize := binary.LittleEndian.Uint32(img[14:18])
+	return dibSize >= 12 && uint64(offset) >= 14+uint64(dibSize) && offset <= size
+}
+
+// ImageMIME returns the MIME type of the image, used to render it.
+func ImageMIME(img []byte) string {
+	format := DetectFormat(img)
+	if format == "" {
+		return "application/octet-stream"
+	}
+	return "image/" + format
+}
+
+// TranscodeToPNG converts the images which tensorflow can not decode.
+func TranscodeToPNG(img []byte) ([]byte, error) {
+	decoded, _, err := image.Decode(bytes.NewReader(img))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, decoded); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ImageSize returns the width and height of the image, without decoding the pixels.
+func ImageSize(img []byte) (int, int, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(img))
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
@@ -0,0 +1,37 @@
+package model
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+
+	"golang.org/x/image/bmp"
+)
+
+func TestDetectFormat(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	var pngImg, bmpImg bytes.Buffer
+	png.Encode(&pngImg, img)
+	bmp.Encode(&bmpImg, img)
+
+	tests := []struct {
+		name   string
+		img    []byte
+		format string
+	}{
+		{"png", pngImg.Bytes(), FormatPNG},
+		{"bmp", bmpImg.Bytes(), FormatBMP},
+		{"jpeg", []byte{0xFF, 0xD8, 0xFF, 0xE0}, FormatJPEG},
+		{"webp", []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), FormatWebP},
+		{"text starting with BM", []byte("BMW is a car maker, not an image format."), ""},
+		{"truncated bmp", bmpImg.Bytes()[:20], ""},
+		{"empty", nil, ""},
+	}
+
+	for _, test := range tests {
+		if format := DetectFormat(test.img); format != test.format {
+			t.Errorf("%v: got %q, want %q", test.name, format, test.format)
+		}
+	}
+}
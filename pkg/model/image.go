@@ -1,110 +1,612 @@
 package model
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 	"github.com/golang/glog"
-	tf "github.com/tensorflow/tensorflow/tensorflow/go"
 )
 
-type ImageDB struct {
-	images map[string]*tf.Tensor
-	rawImages map[string][]byte
-	index map[int]string
+const (
+	// number of bytes of the SHA-256 digest used as image ID
+	imageIDBytes = 8
+)
+
+/*
+ Image is immutable: it is replaced when the file changes.
+ The preprocessed image is not kept with it, see ImageDB.GetInput.
+*/
+type Image struct {
+	// ID is derived from the content, so it stays the same across restarts
+	ID    string
+	// Name is one of the files of the image
+	Name  string
+	// MIME type detected from the content
+	MIME  string
+	// Size of the image file in bytes
+	Size  int
+	// 0 if the format can not be decoded by Go, e.g., some JPEGs
+	Width  int
+	Height int
+	// nil if the ImageDB does not keep the bytes in memory, see ImageDB.Bytes
+	Bytes []byte
+	// feature vector for similarity search; nil if the model has no embedding
+	Embedding []float32
 }
 
-func NewImageDB () *ImageDB {
-	images := make(map[string]*tf.Tensor)
-	rawImages := make(map[string][]byte)
-	index := make(map[int]string)
+/*
+ ImageDB is safe for concurrent use: the watcher updates it while the handlers read it.
+ Images are indexed by their content hash; files with the same content share one image.
+*/
+type ImageDB struct {
+	lock sync.RWMutex
+	images map[string]*Image
+	// the files of each image
+	files map[string]map[string]bool
+	// image ID of each file
+	paths map[string]string
+
+	// image IDs, and the position of each ID, for O(1) random selection
+	ids []string
+	positions map[string]int
+
+	// used to preprocess the loaded images
+	model Classifier
+
+	// nearest neighbour index of the embeddings
+	index VectorIndex
+
+	// called when an image is added or removed; they should not block
+	listeners []func()
+
+	// the recently used preprocessed images
+	inputs *inputCache
+	// if false, the bytes are read from the files on demand
+	keepBytes bool
+	// number of goroutines to load the images of a dir
+	workers int
+
+	// memory used by the kept bytes and the embeddings
+	rawBytes       int64
+	embeddingBytes int64
 
+	// records the loaded images; nil if there is no store
+	store Store
+}
+
+func NewImageDB (m Classifier) *ImageDB {
 	return &ImageDB{
-		images: images,
-		rawImages: rawImages,
-		index: index,
+		images: make(map[string]*Image),
+		files: make(map[string]map[string]bool),
+		paths: make(map[string]string),
+		ids: []string{},
+		positions: make(map[string]int),
+		model: m,
+		index: &autoIndex{brute: NewBruteForceIndex()},
+		inputs: newInputCache(DefaultInputCacheBytes),
+		keepBytes: true,
+		workers: 1,
 	}
 }
 
-func (db *ImageDB) Add(fname string, tensor *tf.Tensor, bytes []byte) {
-	i := db.Size()
-	db.images[fname] = tensor
-	db.rawImages[fname] = bytes
-	db.index[i] = fname
+// SetInputCache bounds the memory of the preprocessed images kept by ImageDB.
+func (db *ImageDB) SetInputCache(maxBytes int64) {
+	db.inputs = newInputCache(maxBytes)
+}
+
+// SetKeepBytes sets whether the bytes of the images are kept in memory, or read from the files on demand.
+func (db *ImageDB) SetKeepBytes(keep bool) {
+	db.keepBytes = keep
+}
+
+// SetStore sets the store to record the loaded images in.
+func (db *ImageDB) SetStore(store Store) {
+	db.store = store
+}
+
+// SetLoadWorkers sets the number of goroutines which load and preprocess the images of a dir.
+func (db *ImageDB) SetLoadWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	db.workers = workers
+}
+
+// SetIndex replaces the nearest neighbour index with a new one of the kind: auto, brute or hnsw.
+func (db *ImageDB) SetIndex(kind string) error {
+	index, err := NewVectorIndex(kind)
+	if err != nil {
+		return err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	for id, img := range db.images {
+		if img.Embedding != nil {
+			index.Add(id, img.Embedding)
+		}
+	}
+	db.index = index
+	return nil
+}
+
+// OnChange registers a function called when an image is added or removed, with the ImageDB locked.
+func (db *ImageDB) OnChange(listener func()) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.listeners = append(db.listeners, listener)
+}
+
+func (db *ImageDB) changed() {
+	for _, listener := range db.listeners {
+		listener()
+	}
+}
+
+// ImageID returns the hex encoded prefix of the SHA-256 digest of the image
+func ImageID(bytes []byte) string {
+	digest := sha256.Sum256(bytes)
+	return hex.EncodeToString(digest[:imageIDBytes])
+}
+
+// Add a new image file, or update an existing one; returns the image ID.
+// The input is preprocessed by the current version of the model.
+func (db *ImageDB) Add(fname string, input Input, embedding []float32, bytes []byte) string {
+	return db.add(fname, db.model.Info(), input, embedding, bytes)
+}
+
+// add the image file with its input, which is preprocessed by the version of the model with info.
+func (db *ImageDB) add(fname string, info *ModelInfo, input Input, embedding []float32, bytes []byte) string {
+	id := ImageID(bytes)
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if old, exist := db.paths[fname]; exist {
+		if old == id {
+			return id
+		}
+		db.removeFile(fname)
+	}
+
+	db.paths[fname] = id
+	if _, exist := db.images[id]; exist {
+		db.files[id][fname] = true
+		return id
+	}
+
+	img := &Image{
+		ID: id,
+		Name: fname,
+		MIME: ImageMIME(bytes),
+		Size: len(bytes),
+		Embedding: embedding,
+	}
+	img.Width, img.Height, _ = ImageSize(bytes)
+	if db.keepBytes {
+		img.Bytes = bytes
+		db.rawBytes += int64(len(bytes))
+	}
+	db.images[id] = img
+	if input != nil {
+		db.inputs.add(info.Version, id, input, inputSize(info))
+	}
+	if embedding != nil {
+		db.index.Add(id, embedding)
+		db.embeddingBytes += int64(4 * len(embedding))
+	}
+	db.updateFootprint()
+	db.files[id] = map[string]bool{fname: true}
+	db.positions[id] = len(db.ids)
+	db.ids = append(db.ids, id)
+	db.changed()
+	return id
+}
+
+// Remove an image file; the image is removed when it has no file left.
+func (db *ImageDB) Remove(fname string) bool {
+	db.lock.Lock()
+	removed := db.removeFile(fname)
+	db.lock.Unlock()
+
+	if removed && db.store != nil {
+		if err := db.store.RemovePath(fname); err != nil {
+			glog.Errorf("Failed to remove file %v from store: %v", fname, err)
+		}
+	}
+	return removed
+}
+
+func (db *ImageDB) removeFile(fname string) bool {
+	id, exist := db.paths[fname]
+	if !exist {
+		return false
+	}
+	delete(db.paths, fname)
+
+	files := db.files[id]
+	delete(files, fname)
+	if len(files) > 0 {
+		if img := db.images[id]; img.Name == fname {
+			// show the image with a remaining file
+			db.images[id] = &Image{
+				ID: id,
+				Name: firstName(files),
+				MIME: img.MIME,
+				Size: img.Size,
+				Width: img.Width,
+				Height: img.Height,
+				Bytes: img.Bytes,
+				Embedding: img.Embedding,
+			}
+		}
+		return true
+	}
+
+	// the last ID takes the place of the removed one
+	i := db.positions[id]
+	last := len(db.ids) - 1
+	if i != last {
+		lastID := db.ids[last]
+		db.ids[i] = lastID
+		db.positions[lastID] = i
+	}
+	db.ids = db.ids[:last]
+	img := db.images[id]
+	db.rawBytes -= int64(len(img.Bytes))
+	db.embeddingBytes -= int64(4 * len(img.Embedding))
+	db.updateFootprint()
+
+	delete(db.positions, id)
+	delete(db.files, id)
+	delete(db.images, id)
+	db.index.Remove(id)
+	db.inputs.remove(id)
+	db.changed()
+	return true
+}
+
+func (db *ImageDB) updateFootprint() {
+	memoryFootprint.WithLabelValues(memoryBytes).Set(float64(db.rawBytes))
+	memoryFootprint.WithLabelValues(memoryEmbeddings).Set(float64(db.embeddingBytes))
+}
+
+func firstName(files map[string]bool) string {
+	names := []string{}
+	for fname := range files {
+		names = append(names, fname)
+	}
+	sort.Strings(names)
+	return names[0]
+}
+
+// Model returns the Classifier which preprocesses the images
+func (db *ImageDB) Model() Classifier {
+	return db.model
+}
+
+// Has checks whether the file is loaded
+func (db *ImageDB) Has(fname string) bool {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	_, exist := db.paths[fname]
+	return exist
+}
+
+// Files returns the names of the loaded files
+func (db *ImageDB) Files() []string {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	result := make([]string, 0, len(db.paths))
+	for fname := range db.paths {
+		result = append(result, fname)
+	}
+	return result
 }
 
-func (db *ImageDB) Load(fname string) error {
-	bytes, tensor, err := LoadImage(fname)
+func (db *ImageDB) Load(ctx context.Context, fname string) error {
+	bytes, err := ioutil.ReadFile(fname)
 	if err != nil {
-		glog.Errorf("failed to generate tensor from file %v: %v", fname, err)
+		glog.Errorf("Failed to load image from %v: %v", fname, err)
 		return err
 	}
 
-	db.Add(fname, tensor, bytes)
+	// the image is preprocessed at load time only to be embedded, by one version of the model;
+	// otherwise it is preprocessed on first use, see GetInput.
+	model, release := pin(db.model)
+	defer release()
+	info := model.Info()
+	var input Input
+	var embedding []float32
+	if info.EmbeddingOp != "" {
+		if input, err = model.Preprocess(ctx, bytes); err != nil {
+			glog.Errorf("failed to generate tensor from file %v: %v", fname, err)
+			return err
+		}
+		embedding = db.embed(ctx, model, fname, input)
+	}
+
+	begin := time.Now()
+	id := db.add(fname, info, input, embedding, bytes)
+
+	if db.store != nil {
+		img, err := db.Get(id)
+		if err != nil {
+			// removed meanwhile
+			return nil
+		}
+		if err := db.store.SaveImage(img, fname, begin); err != nil {
+			glog.Errorf("Failed to save image %v(%v) in store: %v", id, fname, err)
+		}
+	}
 	return nil
 }
 
+// embed returns the feature vector of an image preprocessed by the model, or nil if the model has no embedding.
+func (db *ImageDB) embed(ctx context.Context, model Classifier, fname string, input Input) []float32 {
+	embedder, ok := model.(Embedder)
+	if !ok {
+		return nil
+	}
+
+	result, err := embedder.EmbedInput(ctx, input)
+	if err != nil {
+		if err != ErrNoEmbedding {
+			glog.Warningf("Failed to embed image %v: %v", fname, err)
+		}
+		return nil
+	}
+	return result
+}
+
+// LoadDir loads all the images in the dir with the load workers, and returns the number of loaded images;
+// the remaining images are not loaded if ctx is done.
+func (db *ImageDB) LoadDir(ctx context.Context, dir string) (int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		glog.Errorf("Failed to readDir %v: %v", dir, err)
+		return 0, fmt.Errorf("Failed to load data: %v", err)
+	}
+
+	fnames := make(chan string)
+	num := int64(0)
+	var wg sync.WaitGroup
+	for i := 0; i < db.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fname := range fnames {
+				if err := db.Load(ctx, fname); err != nil {
+					glog.Errorf("failed to generate tensor from file %v: %v", fname, err)
+					continue
+				}
+				atomic.AddInt64(&num, 1)
+			}
+		}()
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !IsImageFile(file.Name()) {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		fnames <- filepath.Join(dir, file.Name())
+	}
+	close(fnames)
+	wg.Wait()
+
+	return int(num), ContextError(ctx)
+}
+
+// Reprocess drops the preprocessed images, and computes the embeddings again,
+// e.g., after the model is reloaded with new preprocessing.
+func (db *ImageDB) Reprocess() {
+	db.inputs.clear()
+
+	db.lock.RLock()
+	images := make([]*Image, 0, len(db.images))
+	for _, img := range db.images {
+		images = append(images, img)
+	}
+	db.lock.RUnlock()
+
+	glog.V(2).Infof("Begin to preprocess %d images again.", len(images))
+	ctx := context.Background()
+	for _, img := range images {
+		model, release := pin(db.model)
+		input, err := db.GetInput(ctx, model, img.ID)
+		if err != nil {
+			release()
+			glog.Errorf("Failed to preprocess image %v(%v): %v", img.ID, img.Name, err)
+			continue
+		}
+
+		embedding := db.embed(ctx, model, img.Name, input)
+		release()
+
+		db.lock.Lock()
+		if cur, exist := db.images[img.ID]; exist {
+			db.images[img.ID] = &Image{
+				ID: cur.ID,
+				Name: cur.Name,
+				MIME: cur.MIME,
+				Size: cur.Size,
+				Width: cur.Width,
+				Height: cur.Height,
+				Bytes: cur.Bytes,
+				Embedding: embedding,
+			}
+			db.embeddingBytes += int64(4 * (len(embedding) - len(cur.Embedding)))
+			db.updateFootprint()
+			if embedding != nil {
+				db.index.Add(img.ID, embedding)
+			} else {
+				db.index.Remove(img.ID)
+			}
+		}
+		db.lock.Unlock()
+	}
+}
+
 func (db *ImageDB) Print() {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
 	fmt.Printf("Number of Images: %d\n", len(db.images))
-	for fname, bytes := range db.rawImages {
-		fmt.Printf("\t%v : %d\n", fname, len(bytes))
+	for id, img := range db.images {
+		fmt.Printf("\t%v %v : %d\n", id, img.Name, img.Size)
 	}
 }
 
 func (db *ImageDB) Size() int {
-	return len(db.rawImages)
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return len(db.ids)
 }
 
-func (db *ImageDB) Get(fname string) (*tf.Tensor, []byte, error) {
-	bytes := []byte{}
-	tensor, ok := db.images[fname]
+// IDs returns the IDs of all the images
+func (db *ImageDB) IDs() []string {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return append([]string{}, db.ids...)
+}
+
+// Get returns the image by its ID
+func (db *ImageDB) Get(id string) (*Image, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	img, ok := db.images[id]
 	if !ok {
-		return nil, bytes, fmt.Errorf("%s not exists", fname)
+		return nil, NewError(KindNotFound, "image %s not exists", id)
 	}
+	return img, nil
+}
 
-	bytes, ok = db.rawImages[fname]
-	if !ok {
-		return nil, bytes, fmt.Errorf("%s not exist", fname)
+/*
+ GetInput returns the image preprocessed by the model; it is preprocessed again if it is not
+ cached for the version of the model. The model should be the version which consumes the input,
+ e.g., the one pinned by PredictCache.PredictTopK, so that it is not reloaded in between.
+*/
+func (db *ImageDB) GetInput(ctx context.Context, model Classifier, id string) (Input, error) {
+	model, release := pin(model)
+	defer release()
+
+	info := model.Info()
+	if input, ok := db.inputs.get(info.Version, id); ok {
+		return input, nil
 	}
 
-	return tensor, bytes, nil
-}
+	img, err := db.Get(id)
+	if err != nil {
+		return nil, err
+	}
 
-func (db *ImageDB) GetTensor(fname string) (*tf.Tensor, error) {
-	tensor, ok := db.images[fname]
-	if !ok {
-		return nil, fmt.Errorf("%s not exists", fname)
+	bytes, err := db.Bytes(img)
+	if err != nil {
+		return nil, err
+	}
+
+	input, err := model.Preprocess(ctx, bytes)
+	if err != nil {
+		return nil, err
 	}
-	return tensor, nil
+	db.inputs.add(info.Version, id, input, inputSize(info))
+	return input, nil
 }
 
-func (db *ImageDB) GetRawImage(fname string) ([]byte, error) {
-	bytes, ok := db.rawImages[fname]
-	if !ok {
-		glog.Errorf("%s not exists", fname)
-		return bytes, fmt.Errorf("Not exist")
+// Bytes returns the content of the image, from memory or from its file.
+func (db *ImageDB) Bytes(img *Image) ([]byte, error) {
+	if img.Bytes != nil {
+		return img.Bytes, nil
+	}
+
+	bytes, err := ioutil.ReadFile(img.Name)
+	if err != nil {
+		return nil, err
+	}
+	// the file is changed, and will be reloaded by the watcher
+	if ImageID(bytes) != img.ID {
+		return nil, fmt.Errorf("file %v of image %v is changed", img.Name, img.ID)
 	}
 	return bytes, nil
 }
 
-func (db *ImageDB) GetImage(idx int) (string, error) {
-	if db.Size() < 1 {
+func (db *ImageDB) GetRawImage(id string) ([]byte, error) {
+	img, err := db.Get(id)
+	if err != nil {
+		glog.Errorf("%s not exists", id)
+		return []byte{}, err
+	}
+	return db.Bytes(img)
+}
+
+// GetRandomImage returns the ID of a random image
+func (db *ImageDB) GetRandomImage() (string, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	size := len(db.ids)
+	if size < 1 {
 		glog.Errorf("ImageDB is empty.")
-		return "", fmt.Errorf("Empty.")
+		return "", NewError(KindUnavailable, "no image is loaded")
+	}
+
+	return db.ids[rand.Intn(size)], nil
+}
+
+// Similar returns at most k images which look like the image, the most similar first.
+func (db *ImageDB) Similar(id string, k int) ([]*Neighbor, error) {
+	img, err := db.Get(id)
+	if err != nil {
+		return nil, err
 	}
+	if img.Embedding == nil {
+		return nil, ErrNoEmbedding
+	}
+
+	db.lock.RLock()
+	neighbors := db.index.Search(img.Embedding, k+1)
+	db.lock.RUnlock()
 
-	id := idx % db.Size()
-	if id < 0 {
-		id = 0
+	result := []*Neighbor{}
+	for _, n := range neighbors {
+		if n.ID != id && len(result) < k {
+			result = append(result, n)
+		}
 	}
-	return db.index[int(id)], nil
+	return result, nil
 }
 
-func (db *ImageDB) GetRandomImage() (string, error) {
-	if db.Size() < 1 {
-		glog.Errorf("ImageDB is empty.")
-		return "", fmt.Errorf("Empty.")
+// Search returns at most k images which look like the query image.
+func (db *ImageDB) Search(ctx context.Context, bytes []byte, k int) ([]*Neighbor, error) {
+	embedder, ok := db.model.(Embedder)
+	if !ok {
+		return nil, ErrNoEmbedding
 	}
 
-	id := rand.Int31n(int32(db.Size()))
-	return db.index[int(id)], nil
-}
\ No newline at end of file
+	vec, err := embedder.Embed(ctx, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.index.Search(vec, k), nil
+}
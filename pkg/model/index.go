@@ -0,0 +1,461 @@
+package model
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+const (
+	IndexAuto  = "auto"
+	IndexBrute = "brute"
+	IndexHNSW  = "hnsw"
+
+	// the auto index switches from brute-force to HNSW when it holds more vectors than this
+	autoIndexThreshold = 5000
+
+	hnswM              = 16
+	hnswEfConstruction = 200
+	hnswEfSearch       = 64
+)
+
+// Neighbor is a vector found by a VectorIndex, scored by the cosine similarity to the query.
+type Neighbor struct {
+	ID    string  `json:"id"`
+	Score float32 `json:"score"`
+}
+
+/*
+ VectorIndex finds the nearest neighbours of a vector by cosine similarity.
+ It is not safe for concurrent use: Search can run concurrently, but not with Add or Remove.
+*/
+type VectorIndex interface {
+	// Add a vector, or replace the vector of an existing id
+	Add(id string, vec []float32)
+	Remove(id string)
+	// Search returns at most k neighbours, the most similar first
+	Search(vec []float32, k int) []*Neighbor
+	Size() int
+}
+
+func NewVectorIndex(kind string) (VectorIndex, error) {
+	switch kind {
+	case IndexAuto, "":
+		return &autoIndex{brute: NewBruteForceIndex()}, nil
+	case IndexBrute:
+		return NewBruteForceIndex(), nil
+	case IndexHNSW:
+		return NewHNSWIndex(), nil
+	}
+	return nil, fmt.Errorf("unknown index: %v", kind)
+}
+
+// normalize returns a copy of the vector with unit length, so cosine similarity is the dot product.
+func normalize(vec []float32) []float32 {
+	norm := float64(0)
+	for _, v := range vec {
+		norm += float64(v) * float64(v)
+	}
+	norm = math.Sqrt(norm)
+
+	result := make([]float32, len(vec))
+	if norm == 0 {
+		return result
+	}
+	for i, v := range vec {
+		result[i] = float32(float64(v) / norm)
+	}
+	return result
+}
+
+func dot(a, b []float32) float32 {
+	if len(a) != len(b) {
+		return 0
+	}
+	sum := float32(0)
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+type byScore []*Neighbor
+
+func (s byScore) Len() int           { return len(s) }
+func (s byScore) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byScore) Less(i, j int) bool { return s[i].Score > s[j].Score }
+
+/* BruteForceIndex compares the query with all the vectors; it is exact, and fast enough for small sets. */
+type BruteForceIndex struct {
+	vecs map[string][]float32
+}
+
+func NewBruteForceIndex() *BruteForceIndex {
+	return &BruteForceIndex{vecs: make(map[string][]float32)}
+}
+
+func (b *BruteForceIndex) Add(id string, vec []float32) {
+	b.vecs[id] = normalize(vec)
+}
+
+func (b *BruteForceIndex) Remove(id string) {
+	delete(b.vecs, id)
+}
+
+func (b *BruteForceIndex) Search(vec []float32, k int) []*Neighbor {
+	query := normalize(vec)
+	result := make([]*Neighbor, 0, len(b.vecs))
+	for id, v := range b.vecs {
+		result = append(result, &Neighbor{ID: id, Score: dot(query, v)})
+	}
+
+	sort.Sort(byScore(result))
+	if len(result) > k {
+		result = result[:k]
+	}
+	return result
+}
+
+func (b *BruteForceIndex) Size() int {
+	return len(b.vecs)
+}
+
+/*
+ HNSWIndex is an approximate index: Hierarchical Navigable Small World graphs
+ (Malkov and Yashunin, https://arxiv.org/abs/1603.09320).
+ Removed vectors are only marked, and skipped in the results; the graph is
+ rebuilt when half of its nodes are removed.
+*/
+type HNSWIndex struct {
+	m              int
+	efConstruction int
+	efSearch       int
+	levelMult      float64
+
+	nodes []*hnswNode
+	// the current node of each id
+	ids      map[string]int
+	entry    int
+	maxLevel int
+	removed  int
+
+	rand *rand.Rand
+}
+
+type hnswNode struct {
+	id      string
+	vec     []float32
+	removed bool
+	// neighbours in each layer, from layer 0 to the level of the node
+	friends [][]int
+}
+
+func NewHNSWIndex() *HNSWIndex {
+	return &HNSWIndex{
+		m:              hnswM,
+		efConstruction: hnswEfConstruction,
+		efSearch:       hnswEfSearch,
+		levelMult:      1 / math.Log(float64(hnswM)),
+		nodes:          []*hnswNode{},
+		ids:            make(map[string]int),
+		entry:          -1,
+		rand:           rand.New(rand.NewSource(1)),
+	}
+}
+
+func (h *HNSWIndex) Size() int {
+	return len(h.ids)
+}
+
+func (h *HNSWIndex) Remove(id string) {
+	i, exist := h.ids[id]
+	if !exist {
+		return
+	}
+	delete(h.ids, id)
+	h.nodes[i].removed = true
+	h.removed++
+
+	if h.removed > len(h.nodes)/2 {
+		h.rebuild()
+	}
+}
+
+// rebuild the graph with the nodes which are not removed
+func (h *HNSWIndex) rebuild() {
+	glog.V(3).Infof("Rebuild HNSW index: %d nodes, %d removed.", len(h.nodes), h.removed)
+	nodes := h.nodes
+
+	h.nodes = []*hnswNode{}
+	h.ids = make(map[string]int)
+	h.entry = -1
+	h.maxLevel = 0
+	h.removed = 0
+	for _, node := range nodes {
+		if !node.removed {
+			h.insert(node.id, node.vec)
+		}
+	}
+}
+
+func (h *HNSWIndex) Add(id string, vec []float32) {
+	h.Remove(id)
+	h.insert(id, normalize(vec))
+}
+
+// maximum number of neighbours of a node in the layer
+func (h *HNSWIndex) maxFriends(layer int) int {
+	if layer == 0 {
+		return 2 * h.m
+	}
+	return h.m
+}
+
+func (h *HNSWIndex) distance(vec []float32, i int) float32 {
+	return 1 - dot(vec, h.nodes[i].vec)
+}
+
+func (h *HNSWIndex) insert(id string, vec []float32) {
+	level := int(math.Floor(-math.Log(1-h.rand.Float64()) * h.levelMult))
+	node := &hnswNode{id: id, vec: vec, friends: make([][]int, level+1)}
+	cur := len(h.nodes)
+	h.nodes = append(h.nodes, node)
+	h.ids[id] = cur
+
+	if h.entry < 0 {
+		h.entry = cur
+		h.maxLevel = level
+		return
+	}
+
+	entries := []int{h.entry}
+	for layer := h.maxLevel; layer > level; layer-- {
+		found := h.searchLayer(vec, entries, 1, layer)
+		entries = []int{found[0].node}
+	}
+
+	top := level
+	if top > h.maxLevel {
+		top = h.maxLevel
+	}
+	for layer := top; layer >= 0; layer-- {
+		found := h.searchLayer(vec, entries, h.efConstruction, layer)
+
+		friends := []int{}
+		for i := 0; i < len(found) && i < h.m; i++ {
+			friends = append(friends, found[i].node)
+		}
+		node.friends[layer] = friends
+
+		for _, f := range friends {
+			h.connect(f, cur, layer)
+		}
+
+		entries = entries[:0]
+		for _, c := range found {
+			entries = append(entries, c.node)
+		}
+	}
+
+	if level > h.maxLevel {
+		h.maxLevel = level
+		h.entry = cur
+	}
+}
+
+// connect node to friend in the layer, and keep the closest neighbours of node if it has too many.
+func (h *HNSWIndex) connect(node, friend, layer int) {
+	n := h.nodes[node]
+	n.friends[layer] = append(n.friends[layer], friend)
+
+	max := h.maxFriends(layer)
+	if len(n.friends[layer]) <= max {
+		return
+	}
+
+	candidates := make([]candidate, 0, len(n.friends[layer]))
+	for _, f := range n.friends[layer] {
+		candidates = append(candidates, candidate{node: f, dist: h.distance(n.vec, f)})
+	}
+	sort.Sort(byDistance(candidates))
+
+	friends := make([]int, 0, max)
+	for i := 0; i < max; i++ {
+		friends = append(friends, candidates[i].node)
+	}
+	n.friends[layer] = friends
+}
+
+// searchLayer returns the ef closest nodes to vec in the layer, the closest first.
+func (h *HNSWIndex) searchLayer(vec []float32, entries []int, ef, layer int) []candidate {
+	visited := make(map[int]bool)
+	// the nodes to visit, the closest on top
+	candidates := &candidateHeap{}
+	// the found nodes, the farthest on top
+	results := &candidateHeap{farthest: true}
+
+	for _, e := range entries {
+		visited[e] = true
+		c := candidate{node: e, dist: h.distance(vec, e)}
+		heap.Push(candidates, c)
+		heap.Push(results, c)
+	}
+
+	for candidates.Len() > 0 {
+		c := heap.Pop(candidates).(candidate)
+		if results.Len() >= ef && c.dist > results.top().dist {
+			break
+		}
+
+		node := h.nodes[c.node]
+		if layer >= len(node.friends) {
+			continue
+		}
+		for _, f := range node.friends[layer] {
+			if visited[f] {
+				continue
+			}
+			visited[f] = true
+
+			d := h.distance(vec, f)
+			if results.Len() < ef || d < results.top().dist {
+				heap.Push(candidates, candidate{node: f, dist: d})
+				heap.Push(results, candidate{node: f, dist: d})
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+
+	result := make([]candidate, results.Len())
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i] = heap.Pop(results).(candidate)
+	}
+	return result
+}
+
+func (h *HNSWIndex) Search(vec []float32, k int) []*Neighbor {
+	result := []*Neighbor{}
+	if h.entry < 0 || k < 1 {
+		return result
+	}
+	query := normalize(vec)
+
+	entries := []int{h.entry}
+	for layer := h.maxLevel; layer > 0; layer-- {
+		found := h.searchLayer(query, entries, 1, layer)
+		entries = []int{found[0].node}
+	}
+
+	// the removed nodes are in the graph, so search more of them
+	ef := h.efSearch
+	if ef < k {
+		ef = k
+	}
+	ef += h.removed
+
+	for _, c := range h.searchLayer(query, entries, ef, 0) {
+		node := h.nodes[c.node]
+		if node.removed {
+			continue
+		}
+		result = append(result, &Neighbor{ID: node.id, Score: 1 - c.dist})
+		if len(result) >= k {
+			break
+		}
+	}
+	return result
+}
+
+type candidate struct {
+	node int
+	dist float32
+}
+
+type byDistance []candidate
+
+func (s byDistance) Len() int           { return len(s) }
+func (s byDistance) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byDistance) Less(i, j int) bool { return s[i].dist < s[j].dist }
+
+// candidateHeap has the closest candidate on top, or the farthest one if farthest is set.
+type candidateHeap struct {
+	items    []candidate
+	farthest bool
+}
+
+func (q *candidateHeap) Len() int      { return len(q.items) }
+func (q *candidateHeap) Swap(i, j int) { q.items[i], q.items[j] = q.items[j], q.items[i] }
+func (q *candidateHeap) Less(i, j int) bool {
+	if q.farthest {
+		return q.items[i].dist > q.items[j].dist
+	}
+	return q.items[i].dist < q.items[j].dist
+}
+
+func (q *candidateHeap) Push(x interface{}) {
+	q.items = append(q.items, x.(candidate))
+}
+
+func (q *candidateHeap) Pop() interface{} {
+	last := len(q.items) - 1
+	c := q.items[last]
+	q.items = q.items[:last]
+	return c
+}
+
+func (q *candidateHeap) top() candidate {
+	return q.items[0]
+}
+
+/* autoIndex is a BruteForceIndex until it holds autoIndexThreshold vectors, then an HNSWIndex. */
+type autoIndex struct {
+	brute *BruteForceIndex
+	hnsw  *HNSWIndex
+}
+
+func (a *autoIndex) Add(id string, vec []float32) {
+	if a.hnsw != nil {
+		a.hnsw.Add(id, vec)
+		return
+	}
+
+	a.brute.Add(id, vec)
+	if a.brute.Size() < autoIndexThreshold {
+		return
+	}
+
+	glog.V(2).Infof("Switch to HNSW index for %d vectors.", a.brute.Size())
+	a.hnsw = NewHNSWIndex()
+	for id, v := range a.brute.vecs {
+		a.hnsw.insert(id, v)
+	}
+	a.brute = nil
+}
+
+func (a *autoIndex) Remove(id string) {
+	if a.hnsw != nil {
+		a.hnsw.Remove(id)
+		return
+	}
+	a.brute.Remove(id)
+}
+
+func (a *autoIndex) Search(vec []float32, k int) []*Neighbor {
+	if a.hnsw != nil {
+		return a.hnsw.Search(vec, k)
+	}
+	return a.brute.Search(vec, k)
+}
+
+func (a *autoIndex) Size() int {
+	if a.hnsw != nil {
+		return a.hnsw.Size()
+	}
+	return a.brute.Size()
+}
@@ -0,0 +1,118 @@
+package model
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestVectorIndexSearch(t *testing.T) {
+	vecs := map[string][]float32{
+		"x":  {1, 0, 0},
+		"y":  {0, 2, 0},
+		"xy": {1, 1, 0},
+		"-x": {-3, 0, 0},
+	}
+
+	tests := []struct {
+		query []float32
+		k     int
+		ids   []string
+	}{
+		{[]float32{1, 0, 0}, 1, []string{"x"}},
+		// the length does not matter
+		{[]float32{5, 0, 0}, 2, []string{"x", "xy"}},
+		{[]float32{0, 1, 0}, 2, []string{"y", "xy"}},
+		{[]float32{-1, 0, 0}, 1, []string{"-x"}},
+		{[]float32{1, 0.1, 0}, 10, []string{"x", "xy", "y", "-x"}},
+	}
+
+	for _, kind := range []string{IndexAuto, IndexBrute, IndexHNSW} {
+		index, err := NewVectorIndex(kind)
+		if err != nil {
+			t.Fatalf("failed to create index %v: %v", kind, err)
+		}
+		for id, vec := range vecs {
+			index.Add(id, vec)
+		}
+		if index.Size() != len(vecs) {
+			t.Errorf("%v: got size %d, want %d", kind, index.Size(), len(vecs))
+		}
+
+		for _, test := range tests {
+			result := index.Search(test.query, test.k)
+			if len(result) != len(test.ids) {
+				t.Errorf("%v %v: got %d neighbors, want %d", kind, test.query, len(result), len(test.ids))
+				continue
+			}
+			for i, n := range result {
+				if n.ID != test.ids[i] {
+					t.Errorf("%v %v: got neighbor %d %v, want %v", kind, test.query, i, n.ID, test.ids[i])
+				}
+			}
+		}
+
+		index.Remove("x")
+		if result := index.Search([]float32{1, 0, 0}, 1); len(result) != 1 || result[0].ID != "xy" {
+			t.Errorf("%v: got %v after removing x, want xy", kind, result)
+		}
+	}
+
+	if _, err := NewVectorIndex("unknown"); err == nil {
+		t.Errorf("got no error for an unknown index")
+	}
+}
+
+// HNSW is approximate, so it should find most of the exact neighbors
+func TestHNSWRecall(t *testing.T) {
+	const (
+		num     = 2000
+		dim     = 32
+		k       = 10
+		queries = 50
+	)
+
+	r := rand.New(rand.NewSource(1))
+	randomVector := func() []float32 {
+		vec := make([]float32, dim)
+		for i := range vec {
+			vec[i] = float32(r.NormFloat64())
+		}
+		return vec
+	}
+	brute, hnsw := NewBruteForceIndex(), NewHNSWIndex()
+	for i := 0; i < num; i++ {
+		id := fmt.Sprintf("%d", i)
+		vec := randomVector()
+		brute.Add(id, vec)
+		hnsw.Add(id, vec)
+	}
+	// the removed ones are skipped
+	for i := 0; i < num; i += 4 {
+		id := fmt.Sprintf("%d", i)
+		brute.Remove(id)
+		hnsw.Remove(id)
+	}
+	if hnsw.Size() != brute.Size() {
+		t.Fatalf("got size %d, want %d", hnsw.Size(), brute.Size())
+	}
+
+	found := 0
+	for i := 0; i < queries; i++ {
+		query := randomVector()
+		exact := map[string]bool{}
+		for _, n := range brute.Search(query, k) {
+			exact[n.ID] = true
+		}
+		for _, n := range hnsw.Search(query, k) {
+			if exact[n.ID] {
+				found++
+			}
+		}
+	}
+
+	recall := float64(found) / (queries * k)
+	if recall < 0.9 {
+		t.Errorf("got recall %.3f, want at least 0.9", recall)
+	}
+}
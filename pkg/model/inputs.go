@@ -0,0 +1,88 @@
+package model
+
+import (
+	"sync"
+)
+
+const (
+	// default max size of the preprocessed images kept in memory: ~400 inception5h tensors
+	DefaultInputCacheBytes = 256 << 20
+
+	// estimated size of an input which is not a tensor
+	inputOverhead = 64
+)
+
+/*
+ inputCache keeps the recently used preprocessed images, by model version and image ID;
+ the least recently used ones are dropped when their total size exceeds the bound, and
+ preprocessed again on demand. The inputs of an old version are never returned for a
+ reloaded model, they age out.
+*/
+type inputCache struct {
+	lock sync.Mutex
+	lru  *lruCache
+}
+
+type inputKey struct {
+	version string
+	id      string
+}
+
+func newInputCache(maxBytes int64) *inputCache {
+	return &inputCache{
+		lru: newLRUCache(int(^uint(0)>>1), maxBytes, nil),
+	}
+}
+
+// size of an input of the model: its float32 tensor of InputShape dominates the memory
+func inputSize(info *ModelInfo) int64 {
+	if len(info.InputShape) < 1 {
+		return inputOverhead
+	}
+
+	size := int64(4)
+	for _, d := range info.InputShape {
+		size *= int64(d)
+	}
+	return size + inputOverhead
+}
+
+func (c *inputCache) get(version, id string) (Input, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	value, exist := c.lru.get(inputKey{version, id})
+	if !exist {
+		inputRequests.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	inputRequests.WithLabelValues("hit").Inc()
+	return value.(Input), true
+}
+
+func (c *inputCache) add(version, id string, input Input, size int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lru.add(inputKey{version, id}, input, size)
+	memoryFootprint.WithLabelValues(memoryInputs).Set(float64(c.lru.bytes))
+}
+
+// remove the inputs of the image, of all the versions
+func (c *inputCache) remove(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lru.removeIf(func(key interface{}) bool {
+		return key.(inputKey).id == id
+	})
+	memoryFootprint.WithLabelValues(memoryInputs).Set(float64(c.lru.bytes))
+}
+
+func (c *inputCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lru.clear()
+	memoryFootprint.WithLabelValues(memoryInputs).Set(0)
+}
@@ -0,0 +1,256 @@
+package model
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+/*
+ LabelIndex is an inverted index from the predicted labels to the images of an ImageDB.
+ The top-k labels of the images are predicted in the background, when the images
+ are added; labels are matched case-insensitively by prefix.
+*/
+type LabelIndex struct {
+	db *ImageDB
+	k  int
+	// the predictions are read from, and saved in the cache if it is set
+	cache *PredictCache
+
+	lock sync.RWMutex
+	// confidence of the images for each label, by lower-case label
+	images map[string]map[string]float32
+	// predicted labels of each image
+	labels map[string][]*LabelWeight
+	// sorted lower-case labels of the model, for prefix search
+	sorted []string
+
+	// signaled when the ImageDB is changed
+	changed chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// LabelMatch is an image whose predicted label matches the query.
+type LabelMatch struct {
+	ID    string  `json:"id"`
+	Label string  `json:"label"`
+	Score float32 `json:"score"`
+}
+
+type byMatchScore []*LabelMatch
+
+func (s byMatchScore) Len() int           { return len(s) }
+func (s byMatchScore) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byMatchScore) Less(i, j int) bool { return s[i].Score > s[j].Score }
+
+// NewLabelIndex indexes the top-k predicted labels of the images in db.
+func NewLabelIndex(db *ImageDB, k int) *LabelIndex {
+	idx := &LabelIndex{
+		db:      db,
+		k:       k,
+		images:  make(map[string]map[string]float32),
+		labels:  make(map[string][]*LabelWeight),
+		changed: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	idx.sorted = sortedLabels(db.Model().GetLabels())
+	db.OnChange(idx.notify)
+	return idx
+}
+
+func sortedLabels(labels []string) []string {
+	result := make([]string, 0, len(labels))
+	for _, label := range labels {
+		result = append(result, strings.ToLower(label))
+	}
+	sort.Strings(result)
+	return result
+}
+
+// SetCache sets the cache used by the predictions, e.g., to reuse the stored predictions.
+func (idx *LabelIndex) SetCache(cache *PredictCache) {
+	idx.cache = cache
+}
+
+// notify the worker without blocking; one pending signal is enough.
+func (idx *LabelIndex) notify() {
+	select {
+	case idx.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Start predicting the images in the background.
+func (idx *LabelIndex) Start() {
+	idx.wg.Add(1)
+	go func() {
+		defer idx.wg.Done()
+
+		idx.sync()
+		for {
+			select {
+			case <-idx.stop:
+				return
+			case <-idx.changed:
+				idx.sync()
+			}
+		}
+	}()
+}
+
+func (idx *LabelIndex) Stop() {
+	close(idx.stop)
+	idx.wg.Wait()
+}
+
+// Invalidate drops all the predictions, e.g., after the model is reloaded; they are predicted again.
+func (idx *LabelIndex) Invalidate() {
+	idx.lock.Lock()
+	idx.images = make(map[string]map[string]float32)
+	idx.labels = make(map[string][]*LabelWeight)
+	idx.sorted = sortedLabels(idx.db.Model().GetLabels())
+	idx.lock.Unlock()
+
+	idx.notify()
+}
+
+// sync predicts the new images, and drops the removed ones.
+func (idx *LabelIndex) sync() {
+	ids := idx.db.IDs()
+	current := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		current[id] = true
+	}
+
+	idx.lock.Lock()
+	for id := range idx.labels {
+		if !current[id] {
+			idx.remove(id)
+		}
+	}
+	idx.lock.Unlock()
+
+	// the predictions of the index have no deadline
+	ctx := context.Background()
+	num := 0
+	for _, id := range ids {
+		select {
+		case <-idx.stop:
+			return
+		default:
+		}
+
+		if idx.has(id) {
+			continue
+		}
+
+		model := idx.db.Model()
+		result, _, err := idx.cache.PredictTopK(id, model, idx.k, false, func(model Classifier) (*PredictResult, error) {
+			input, err := idx.db.GetInput(ctx, model, id)
+			if err != nil {
+				return nil, err
+			}
+			return model.PredictTopKInput(ctx, input, idx.k)
+		})
+		if err != nil {
+			glog.Errorf("Failed to predict image %v for label index: %v", id, err)
+			continue
+		}
+		idx.add(id, result.Labels)
+		num++
+	}
+
+	if num > 0 {
+		glog.V(2).Infof("Indexed labels of %d images.", num)
+	}
+}
+
+func (idx *LabelIndex) has(id string) bool {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	_, exist := idx.labels[id]
+	return exist
+}
+
+func (idx *LabelIndex) add(id string, labels []*LabelWeight) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	idx.remove(id)
+	idx.labels[id] = labels
+	for _, lw := range labels {
+		label := strings.ToLower(lw.Label)
+		if _, exist := idx.images[label]; !exist {
+			idx.images[label] = make(map[string]float32)
+		}
+		idx.images[label][id] = lw.Weight
+	}
+}
+
+func (idx *LabelIndex) remove(id string) {
+	for _, lw := range idx.labels[id] {
+		label := strings.ToLower(lw.Label)
+		delete(idx.images[label], id)
+		if len(idx.images[label]) < 1 {
+			delete(idx.images, label)
+		}
+	}
+	delete(idx.labels, id)
+}
+
+// Size returns the number of indexed images.
+func (idx *LabelIndex) Size() int {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	return len(idx.labels)
+}
+
+// Search returns the images which have a label starting with the query, the most confident first.
+// An image matching several labels is returned once, with its most confident label.
+func (idx *LabelIndex) Search(query string, minScore float32) []*LabelMatch {
+	prefix := strings.ToLower(strings.TrimSpace(query))
+
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	best := make(map[string]*LabelMatch)
+	for i := sort.SearchStrings(idx.sorted, prefix); i < len(idx.sorted); i++ {
+		label := idx.sorted[i]
+		if !strings.HasPrefix(label, prefix) {
+			break
+		}
+
+		for id, score := range idx.images[label] {
+			if score < minScore {
+				continue
+			}
+			if m, exist := best[id]; exist && m.Score >= score {
+				continue
+			}
+			best[id] = &LabelMatch{ID: id, Label: idx.originalLabel(id, label), Score: score}
+		}
+	}
+
+	result := make([]*LabelMatch, 0, len(best))
+	for _, m := range best {
+		result = append(result, m)
+	}
+	sort.Sort(byMatchScore(result))
+	return result
+}
+
+// the label as predicted by the model, rather than lower-case
+func (idx *LabelIndex) originalLabel(id, label string) string {
+	for _, lw := range idx.labels[id] {
+		if strings.ToLower(lw.Label) == label {
+			return lw.Label
+		}
+	}
+	return label
+}
@@ -0,0 +1,88 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// waitIndexed waits until the label index has n images
+func waitIndexed(t *testing.T, idx *LabelIndex, n int) {
+	for begin := time.Now(); time.Since(begin) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if idx.Size() == n {
+			return
+		}
+	}
+	t.Fatalf("got %d images indexed, want %d", idx.Size(), n)
+}
+
+func TestLabelIndexSearch(t *testing.T) {
+	model := NewFakeClassifier([]string{"Tabby cat", "tiger cat", "Tiger", "sports car", "convertible"})
+	db := NewImageDB(model)
+	for i := 0; i < 20; i++ {
+		fname := fmt.Sprintf("image-%d.jpg", i)
+		input, _ := model.Preprocess(context.Background(), []byte(fname))
+		db.Add(fname, input, nil, []byte(fname))
+	}
+	idx := NewLabelIndex(db, 2)
+	idx.Start()
+	defer idx.Stop()
+	waitIndexed(t, idx, 20)
+
+	tests := []struct {
+		query    string
+		minScore float32
+		// the labels the matches can have
+		labels []string
+	}{
+		{"tabby", 0, []string{"Tabby cat"}},
+		{"TABBY", 0, []string{"Tabby cat"}},
+		{" tiger ", 0, []string{"tiger cat", "Tiger"}},
+		{"tiger c", 0, []string{"tiger cat"}},
+		{"t", 0.3, []string{"Tabby cat", "tiger cat", "Tiger"}},
+		{"", 0, []string{"Tabby cat", "tiger cat", "Tiger", "sports car", "convertible"}},
+		{"cat", 0, []string{}},
+		{"dog", 0, []string{}},
+	}
+
+	for _, test := range tests {
+		allowed := map[string]bool{}
+		for _, label := range test.labels {
+			allowed[label] = true
+		}
+
+		// the expected matches, from the predictions of the images
+		want := map[string]float32{}
+		for _, id := range db.IDs() {
+			input, _ := db.GetInput(context.Background(), model, id)
+			result, _ := model.PredictTopKInput(context.Background(), input, 2)
+			for _, lw := range result.Labels {
+				if allowed[lw.Label] && lw.Weight >= test.minScore && lw.Weight > want[id] {
+					want[id] = lw.Weight
+				}
+			}
+		}
+
+		matches := idx.Search(test.query, test.minScore)
+		if len(matches) != len(want) {
+			t.Errorf("%q: got %d matches, want %d", test.query, len(matches), len(want))
+			continue
+		}
+		for i, m := range matches {
+			if !allowed[m.Label] {
+				t.Errorf("%q: got label %q", test.query, m.Label)
+			}
+			if m.Score != want[m.ID] {
+				t.Errorf("%q: got score %v of %v, want %v", test.query, m.Score, m.ID, want[m.ID])
+			}
+			if i > 0 && matches[i-1].Score < m.Score {
+				t.Errorf("%q: matches are not sorted by score", test.query)
+			}
+		}
+	}
+
+	// the removed images are dropped in the background
+	db.Remove("image-0.jpg")
+	waitIndexed(t, idx, 19)
+}
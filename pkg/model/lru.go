@@ -0,0 +1,103 @@
+package model
+
+import (
+	"container/list"
+)
+
+/*
+ lruCache is bounded by the number of entries and their total size in bytes;
+ the least recently used entries are evicted first. It is not safe for concurrent use.
+*/
+type lruCache struct {
+	maxEntries int
+	maxBytes   int64
+
+	bytes int64
+	// the most recently used first
+	list    *list.List
+	entries map[interface{}]*list.Element
+
+	// called for each evicted entry
+	onEvict func(key interface{})
+}
+
+type lruEntry struct {
+	key   interface{}
+	value interface{}
+	size  int64
+}
+
+func newLRUCache(maxEntries int, maxBytes int64, onEvict func(key interface{})) *lruCache {
+	return &lruCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		list:       list.New(),
+		entries:    make(map[interface{}]*list.Element),
+		onEvict:    onEvict,
+	}
+}
+
+func (c *lruCache) get(key interface{}) (interface{}, bool) {
+	e, exist := c.entries[key]
+	if !exist {
+		return nil, false
+	}
+	c.list.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+// add the entry, and evict the least recently used ones if the cache is full;
+// an entry larger than the cache is not added.
+func (c *lruCache) add(key, value interface{}, size int64) {
+	if size > c.maxBytes {
+		return
+	}
+
+	if e, exist := c.entries[key]; exist {
+		c.removeElement(e)
+	}
+	c.entries[key] = c.list.PushFront(&lruEntry{key: key, value: value, size: size})
+	c.bytes += size
+
+	for c.list.Len() > c.maxEntries || c.bytes > c.maxBytes {
+		e := c.list.Back()
+		c.removeElement(e)
+		if c.onEvict != nil {
+			c.onEvict(e.Value.(*lruEntry).key)
+		}
+	}
+}
+
+func (c *lruCache) remove(key interface{}) {
+	if e, exist := c.entries[key]; exist {
+		c.removeElement(e)
+	}
+}
+
+// removeIf removes the entries whose key matches
+func (c *lruCache) removeIf(match func(key interface{}) bool) {
+	for e := c.list.Front(); e != nil; {
+		next := e.Next()
+		if match(e.Value.(*lruEntry).key) {
+			c.removeElement(e)
+		}
+		e = next
+	}
+}
+
+func (c *lruCache) removeElement(e *list.Element) {
+	entry := e.Value.(*lruEntry)
+	c.list.Remove(e)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+}
+
+func (c *lruCache) clear() {
+	c.list.Init()
+	c.entries = make(map[interface{}]*list.Element)
+	c.bytes = 0
+}
+
+func (c *lruCache) len() int {
+	return c.list.Len()
+}
@@ -0,0 +1,140 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+// keys of the cache, the most recently used first
+func lruKeys(c *lruCache) []interface{} {
+	keys := []interface{}{}
+	for e := c.list.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(*lruEntry).key)
+	}
+	return keys
+}
+
+func TestLRUCache(t *testing.T) {
+	type op struct {
+		// "add", "get", or "remove"
+		name string
+		key  string
+		size int64
+	}
+
+	tests := []struct {
+		name       string
+		maxEntries int
+		maxBytes   int64
+		ops        []op
+		keys       []interface{}
+		bytes      int64
+		evicted    []interface{}
+	}{
+		{
+			name:       "evict by entries",
+			maxEntries: 2, maxBytes: 100,
+			ops:     []op{{"add", "a", 1}, {"add", "b", 1}, {"add", "c", 1}},
+			keys:    []interface{}{"c", "b"},
+			bytes:   2,
+			evicted: []interface{}{"a"},
+		},
+		{
+			name:       "evict by bytes",
+			maxEntries: 10, maxBytes: 10,
+			ops:     []op{{"add", "a", 4}, {"add", "b", 4}, {"add", "c", 4}},
+			keys:    []interface{}{"c", "b"},
+			bytes:   8,
+			evicted: []interface{}{"a"},
+		},
+		{
+			name:       "get is a use",
+			maxEntries: 2, maxBytes: 100,
+			ops:     []op{{"add", "a", 1}, {"add", "b", 1}, {"get", "a", 0}, {"add", "c", 1}},
+			keys:    []interface{}{"c", "a"},
+			bytes:   2,
+			evicted: []interface{}{"b"},
+		},
+		{
+			name:       "replace",
+			maxEntries: 2, maxBytes: 100,
+			ops:     []op{{"add", "a", 1}, {"add", "b", 1}, {"add", "a", 5}},
+			keys:    []interface{}{"a", "b"},
+			bytes:   6,
+			evicted: []interface{}{},
+		},
+		{
+			name:       "too large",
+			maxEntries: 2, maxBytes: 10,
+			ops:     []op{{"add", "a", 1}, {"add", "b", 11}},
+			keys:    []interface{}{"a"},
+			bytes:   1,
+			evicted: []interface{}{},
+		},
+		{
+			name:       "remove",
+			maxEntries: 2, maxBytes: 100,
+			ops:     []op{{"add", "a", 1}, {"add", "b", 2}, {"remove", "a", 0}, {"remove", "x", 0}},
+			keys:    []interface{}{"b"},
+			bytes:   2,
+			evicted: []interface{}{},
+		},
+	}
+
+	for _, test := range tests {
+		evicted := []interface{}{}
+		c := newLRUCache(test.maxEntries, test.maxBytes, func(key interface{}) {
+			evicted = append(evicted, key)
+		})
+		for _, op := range test.ops {
+			switch op.name {
+			case "add":
+				c.add(op.key, op.key+"-value", op.size)
+			case "get":
+				if v, ok := c.get(op.key); !ok || v != op.key+"-value" {
+					t.Errorf("%v: got %v, %v for %v", test.name, v, ok, op.key)
+				}
+			case "remove":
+				c.remove(op.key)
+			}
+		}
+
+		if keys := lruKeys(c); !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("%v: got keys %v, want %v", test.name, keys, test.keys)
+		}
+		if c.len() != len(test.keys) {
+			t.Errorf("%v: got len %d, want %d", test.name, c.len(), len(test.keys))
+		}
+		if c.bytes != test.bytes {
+			t.Errorf("%v: got %d bytes, want %d", test.name, c.bytes, test.bytes)
+		}
+		if !reflect.DeepEqual(evicted, test.evicted) {
+			t.Errorf("%v: got evicted %v, want %v", test.name, evicted, test.evicted)
+		}
+	}
+}
+
+func TestLRUCacheRemoveIf(t *testing.T) {
+	c := newLRUCache(10, 100, nil)
+	for _, key := range []string{"a1", "b1", "a2", "b2"} {
+		c.add(key, key, 1)
+	}
+
+	c.removeIf(func(key interface{}) bool {
+		return key.(string)[0] == 'a'
+	})
+	if keys := lruKeys(c); !reflect.DeepEqual(keys, []interface{}{"b2", "b1"}) {
+		t.Errorf("got keys %v, want [b2 b1]", keys)
+	}
+	if _, ok := c.get("a1"); ok {
+		t.Errorf("got removed key a1")
+	}
+	if c.bytes != 2 {
+		t.Errorf("got %d bytes, want 2", c.bytes)
+	}
+
+	c.clear()
+	if c.len() != 0 || c.bytes != 0 {
+		t.Errorf("got %d entries, %d bytes after clear", c.len(), c.bytes)
+	}
+}
@@ -0,0 +1,52 @@
+package model
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	memoryBytes      = "bytes"
+	memoryInputs     = "inputs"
+	memoryEmbeddings = "embeddings"
+)
+
+var (
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prediction_cache_requests_total",
+		Help: "Number of prediction cache lookups, by result: hit, store (found in the store) or miss",
+	}, []string{"model", "result"})
+
+	cacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prediction_cache_evictions_total",
+		Help: "Number of results evicted from the prediction cache to keep it in its bounds",
+	}, []string{"model"})
+
+	cacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prediction_cache_entries",
+		Help: "Number of results in the prediction cache",
+	})
+
+	cacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prediction_cache_bytes",
+		Help: "Estimated size of the results in the prediction cache",
+	})
+
+	inputRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imagedb_input_cache_requests_total",
+		Help: "Number of lookups of the preprocessed images, by result: hit or miss",
+	}, []string{"result"})
+
+	memoryFootprint = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "imagedb_memory_bytes",
+		Help: "Memory used by ImageDB, by kind: raw image bytes, cached preprocessed inputs and embeddings",
+	}, []string{"kind"})
+)
+
+func init() {
+	prometheus.MustRegister(cacheRequests)
+	prometheus.MustRegister(cacheEvictions)
+	prometheus.MustRegister(cacheEntries)
+	prometheus.MustRegister(cacheBytes)
+	prometheus.MustRegister(inputRequests)
+	prometheus.MustRegister(memoryFootprint)
+}
@@ -0,0 +1,162 @@
+package model
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+/*
+ Registry holds the loaded models by name; the first added model is the default one.
+ It is safe for concurrent use.
+*/
+type Registry struct {
+	lock   sync.RWMutex
+	models map[string]Classifier
+	// names in the order the models are added
+	names []string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		models: make(map[string]Classifier),
+		names:  []string{},
+	}
+}
+
+func (r *Registry) Add(name string, m Classifier) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, exist := r.models[name]; exist {
+		return fmt.Errorf("model %v already exists", name)
+	}
+
+	r.models[name] = m
+	r.names = append(r.names, name)
+	return nil
+}
+
+// Get returns the model by name, or the default model if name is empty.
+func (r *Registry) Get(name string) (Classifier, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if name == "" {
+		if len(r.names) < 1 {
+			return nil, NewError(KindUnavailable, "no model is loaded")
+		}
+		name = r.names[0]
+	}
+
+	m, exist := r.models[name]
+	if !exist {
+		return nil, NewError(KindNotFound, "model %v not exists", name)
+	}
+	return m, nil
+}
+
+// Default returns the first added model, or nil if there is no model.
+func (r *Registry) Default() Classifier {
+	m, err := r.Get("")
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+// Reload the model by name, if it is a Reloader.
+func (r *Registry) Reload(name string) error {
+	m, err := r.Get(name)
+	if err != nil {
+		return err
+	}
+
+	reloader, ok := m.(Reloader)
+	if !ok {
+		return NewError(KindNotImplemented, "model %v can not be reloaded", name)
+	}
+	return reloader.Reload()
+}
+
+// ReloadAll reloads all the models which are Reloaders; returns the last error.
+func (r *Registry) ReloadAll() error {
+	var result error
+	for _, name := range r.Names() {
+		m, err := r.Get(name)
+		if err != nil {
+			continue
+		}
+
+		if reloader, ok := m.(Reloader); ok {
+			if err := reloader.Reload(); err != nil {
+				result = err
+			}
+		}
+	}
+	return result
+}
+
+// Reloading returns the names of the models being reloaded.
+func (r *Registry) Reloading() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	result := []string{}
+	for _, name := range r.names {
+		if reloader, ok := r.models[name].(Reloader); ok && reloader.Reloading() {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// Verify checks the models which are Verifiers with a smoke prediction; returns the first error.
+func (r *Registry) Verify() error {
+	for _, name := range r.Names() {
+		m, err := r.Get(name)
+		if err != nil {
+			return err
+		}
+
+		if verifier, ok := m.(Verifier); ok {
+			if err := verifier.Verify(); err != nil {
+				return fmt.Errorf("model %v: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Registry) Names() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return append([]string{}, r.names...)
+}
+
+func (r *Registry) Infos() []*ModelInfo {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	result := []*ModelInfo{}
+	for _, name := range r.names {
+		result = append(result, r.models[name].Info())
+	}
+	return result
+}
+
+func (r *Registry) Close() error {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	var result error
+	for _, name := range r.names {
+		if err := r.models[name].Close(); err != nil {
+			glog.Errorf("Failed to close model %v: %v", name, err)
+			result = err
+		}
+	}
+	return result
+}
@@ -0,0 +1,27 @@
+package model
+
+// Reloader is implemented by the models which can be reloaded without restarting the server.
+type Reloader interface {
+	Reload() error
+	// Reloading tells whether a reload is in progress, until the work after the swap is done
+	Reloading() bool
+}
+
+// Pinner is implemented by the models which serve several versions over time.
+type Pinner interface {
+	// Pin returns the current version, which is not closed until release is called
+	Pin() (model Classifier, release func())
+}
+
+// pin returns the current version of the model if it is a Pinner, or else the model itself
+func pin(model Classifier) (Classifier, func()) {
+	if pinner, ok := model.(Pinner); ok {
+		return pinner.Pin()
+	}
+	return model, func() {}
+}
+
+// Verifier is implemented by the models which can check themselves with a smoke prediction.
+type Verifier interface {
+	Verify() error
+}
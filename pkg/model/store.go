@@ -0,0 +1,21 @@
+package model
+
+import (
+	"time"
+)
+
+/*
+ Store persists the images and their predictions across restarts; see pkg/store.
+ The predictions are keyed by the image ID, the model version and k.
+*/
+type Store interface {
+	// SaveImage records the image loaded from the file
+	SaveImage(img *Image, fname string, loadedAt time.Time) error
+	// RemovePath forgets the file, which is removed or renamed
+	RemovePath(fname string) error
+	// GetPrediction returns nil if the prediction is not stored
+	GetPrediction(imageID, version string, k int) (*PredictResult, error)
+	// SavePrediction saves the prediction of an image recorded by SaveImage, and ignores the others
+	SavePrediction(imageID, version string, k int, result *PredictResult) error
+	Close() error
+}
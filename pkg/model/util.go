@@ -1,13 +1,9 @@
 package model
 
 import (
-	"archive/zip"
 	"fmt"
-	"github.com/golang/glog"
-	"io"
-	"net/http"
 	"os"
-	"path/filepath"
+	"sort"
 	"time"
 	"bytes"
 )
@@ -24,34 +20,39 @@ func (a ByWeight) Len() int           { return len(a) }
 func (a ByWeight) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByWeight) Less(i, j int) bool { return a[i].Weight > a[j].Weight }
 
-type labelWeight struct {
-	Label string
-	Weight float32
+type LabelWeight struct {
+	Label  string  `json:"label"`
+	Weight float32 `json:"probability"`
 }
 
-func NewLabelWeight(label string, weight float32) *labelWeight {
-	return &labelWeight{
+func NewLabelWeight(label string, weight float32) *LabelWeight {
+	return &LabelWeight{
 		Label: label,
 		Weight: weight,
 	}
 }
 
+/* PredictResult is shared by the CLI and the JSON API of the server. */
 type PredictResult struct {
-	array []*labelWeight
+	Model     string         `json:"model"`
+	Labels    []*LabelWeight `json:"labels"`
+	PredictMs float64        `json:"predict_ms"`
 }
 
 func NewPredictResult() *PredictResult {
-	return &PredictResult{}
+	return &PredictResult{
+		Labels: []*LabelWeight{},
+	}
 }
 
-func (r *PredictResult) Add(lw *labelWeight) {
-	r.array = append(r.array, lw)
+func (r *PredictResult) Add(lw *LabelWeight) {
+	r.Labels = append(r.Labels, lw)
 }
 
 func (r *PredictResult) String() string {
 	var buffer bytes.Buffer
 
-	for i, lw := range r.array {
+	for i, lw := range r.Labels {
 		w := fmt.Sprintf("\t[Top-%d] %2.1f%% likely ", i+1, lw.Weight*100)
 		buffer.WriteString(w)
 		buffer.WriteString(lw.Label)
@@ -64,7 +65,7 @@ func (r *PredictResult) String() string {
 func (r *PredictResult) GenTableString() string {
 	var buf bytes.Buffer
 
-	for _, lw := range r.array {
+	for _, lw := range r.Labels {
 		buf.WriteString("<tr>")
 		tmp := fmt.Sprintf("<td>%2.1f%% </td> ", lw.Weight*100)
 		buf.WriteString(tmp)
@@ -76,57 +77,46 @@ func (r *PredictResult) GenTableString() string {
 	return buf.String()
 }
 
+// TopK returns the k labels of the highest probabilities, the most probable first.
+func TopK(model string, labels []string, probabilities []float32, k int, begin time.Time) (*PredictResult, error) {
+	if len(probabilities) > len(labels) {
+		return nil, fmt.Errorf("got %d probabilities for %d labels", len(probabilities), len(labels))
+	}
 
-func timeTrack(start time.Time, name string) time.Duration{
-	elapsed := time.Since(start)
-	glog.V(2).Infof("%s took %s", name, elapsed)
-	return elapsed
-}
-
-func FilesExist(files ...string) error {
-	for _, f := range files {
-		if _, err := os.Stat(f); err != nil {
-			return fmt.Errorf("unable to stat %s: %v", f, err)
+	pairs := []*Pair{}
+	for i, p := range probabilities {
+		pair := &Pair{
+			Index:  i,
+			Weight: p,
 		}
+		pairs = append(pairs, pair)
 	}
-	return nil
-}
 
-func download(URL, filename string) error {
-	resp, err := http.Get(URL)
-	if err != nil {
-		return err
+	sort.Sort(ByWeight(pairs))
+
+	if k > len(pairs) {
+		k = len(pairs)
 	}
-	defer resp.Body.Close()
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return err
+
+	result := NewPredictResult()
+	result.Model = model
+	for i := 0; i < k; i++ {
+		p := pairs[i]
+		lw := NewLabelWeight(labels[p.Index], p.Weight)
+		result.Add(lw)
+		if p.Weight < 0.0005 {
+			break
+		}
 	}
-	defer file.Close()
-	_, err = io.Copy(file, resp.Body)
-	return err
+	result.PredictMs = time.Since(begin).Seconds() * 1000
+	return result, nil
 }
 
-func unzip(dir, zipfile string) error {
-	r, err := zip.OpenReader(zipfile)
-	if err != nil {
-		return err
-	}
-	defer r.Close()
-	for _, f := range r.File {
-		src, err := f.Open()
-		if err != nil {
-			return err
-		}
-		glog.V(3).Infof("Extracting", f.Name)
-		dst, err := os.OpenFile(filepath.Join(dir, f.Name), os.O_WRONLY|os.O_CREATE, 0644)
-		if err != nil {
-			return err
-		}
-		if _, err := io.Copy(dst, src); err != nil {
-			return err
+func FilesExist(files ...string) error {
+	for _, f := range files {
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Errorf("unable to stat %s: %v", f, err)
 		}
-		dst.Close()
 	}
 	return nil
 }
@@ -0,0 +1,240 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+)
+
+const (
+	WatchAuto    = "auto"
+	WatchInotify = "inotify"
+	WatchPoll    = "poll"
+	WatchOff     = "off"
+
+	// wait for the writes to a new file to settle before loading it
+	settleDelay = 500 * time.Millisecond
+)
+
+/*
+ ImageWatcher keeps the ImageDB in sync with the image dir: new and changed images
+ are loaded, and deleted images are removed.
+ It uses inotify (via fsnotify), and falls back to polling the dir when inotify
+ is not available, e.g., on some network or container volumes.
+*/
+type ImageWatcher struct {
+	dir      string
+	db       *ImageDB
+	mode     string
+	interval time.Duration
+
+	// the files seen by the last scan; nil before the first one
+	files map[string]fileStamp
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func NewImageWatcher(dir string, db *ImageDB, mode string, interval time.Duration) *ImageWatcher {
+	return &ImageWatcher{
+		dir:      filepath.Clean(dir),
+		db:       db,
+		mode:     mode,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+func (w *ImageWatcher) Start() error {
+	switch w.mode {
+	case WatchOff:
+		return nil
+	case WatchPoll:
+		w.startPolling()
+		return nil
+	case WatchInotify:
+		return w.startInotify()
+	case WatchAuto:
+		if err := w.startInotify(); err != nil {
+			glog.Warningf("Failed to watch %v with inotify, will poll it every %v: %v", w.dir, w.interval, err)
+			w.startPolling()
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown watch mode: %v", w.mode)
+}
+
+func (w *ImageWatcher) Stop() {
+	close(w.stop)
+	w.wg.Wait()
+}
+
+func (w *ImageWatcher) startInotify() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := watcher.Add(w.dir); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	glog.V(2).Infof("Begin to watch %v with inotify", w.dir)
+	// the events before the watch is added are missed, e.g., the files created while the dir is loaded
+	w.scan()
+
+	w.wg.Add(1)
+	go w.watch(watcher)
+	return nil
+}
+
+func (w *ImageWatcher) watch(watcher *fsnotify.Watcher) {
+	defer w.wg.Done()
+	defer watcher.Close()
+
+	// files created or written, and when it happened
+	pending := make(map[string]time.Time)
+	ticker := time.NewTicker(settleDelay / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			w.handleEvent(event, pending)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			glog.Errorf("Error while watching %v: %v", w.dir, err)
+		case now := <-ticker.C:
+			for fname, t := range pending {
+				if now.Sub(t) < settleDelay {
+					continue
+				}
+				delete(pending, fname)
+				w.load(fname)
+			}
+		}
+	}
+}
+
+func (w *ImageWatcher) handleEvent(event fsnotify.Event, pending map[string]time.Time) {
+	fname := event.Name
+	if !IsImageFile(filepath.Base(fname)) {
+		return
+	}
+	glog.V(4).Infof("Got event for image dir: %v", event)
+
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		delete(pending, fname)
+		w.remove(fname)
+		return
+	}
+
+	if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+		pending[fname] = time.Now()
+	}
+}
+
+func (w *ImageWatcher) startPolling() {
+	glog.V(2).Infof("Begin to poll %v every %v", w.dir, w.interval)
+	w.scan()
+
+	w.wg.Add(1)
+	go w.poll()
+}
+
+func (w *ImageWatcher) poll() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.scan()
+		}
+	}
+}
+
+// scan loads the new and changed images, and removes the deleted ones.
+func (w *ImageWatcher) scan() {
+	files, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		glog.Errorf("Failed to readDir %v: %v", w.dir, err)
+		return
+	}
+
+	seen := make(map[string]fileStamp)
+	for _, file := range files {
+		if file.IsDir() || !IsImageFile(file.Name()) {
+			continue
+		}
+
+		fname := filepath.Join(w.dir, file.Name())
+		stamp := fileStamp{modTime: file.ModTime(), size: file.Size()}
+		seen[fname] = stamp
+
+		if old, exist := w.files[fname]; exist {
+			if old == stamp {
+				continue
+			}
+		} else if w.db.Has(fname) {
+			// loaded before the first scan
+			continue
+		}
+		w.load(fname)
+	}
+
+	known := w.files
+	if known == nil {
+		// the first scan: the files loaded before
+		known = make(map[string]fileStamp)
+		for _, fname := range w.db.Files() {
+			if filepath.Dir(fname) == w.dir {
+				known[fname] = fileStamp{}
+			}
+		}
+	}
+	for fname := range known {
+		if _, exist := seen[fname]; !exist {
+			w.remove(fname)
+		}
+	}
+	w.files = seen
+}
+
+func (w *ImageWatcher) load(fname string) {
+	if err := w.db.Load(context.Background(), fname); err != nil {
+		glog.Errorf("Failed to load image %v: %v", fname, err)
+		return
+	}
+	glog.V(2).Infof("Loaded image %v", fname)
+}
+
+func (w *ImageWatcher) remove(fname string) {
+	if w.db.Remove(fname) {
+		glog.V(2).Infof("Removed image %v", fname)
+	}
+}
@@ -0,0 +1,42 @@
+package model
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// the files created or removed after the dir is loaded, but before the watcher starts, are synced
+func TestImageWatcherFirstScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+	db := NewImageDB(NewFakeClassifier(nil))
+	if num, err := db.LoadDir(context.Background(), dir); err != nil || num != 2 {
+		t.Fatalf("got %d images loaded, %v, want 2", num, err)
+	}
+
+	os.Remove(filepath.Join(dir, "a.jpg"))
+	ioutil.WriteFile(filepath.Join(dir, "c.jpg"), []byte("c.jpg"), 0644)
+
+	w := NewImageWatcher(dir, db, WatchPoll, time.Hour)
+	if err := w.Start(); err != nil {
+		t.Fatalf("failed to start watcher: %v", err)
+	}
+	defer w.Stop()
+
+	for name, want := range map[string]bool{"a.jpg": false, "b.jpg": true, "c.jpg": true} {
+		if got := db.Has(filepath.Join(dir, name)); got != want {
+			t.Errorf("%v: got loaded %v, want %v", name, got, want)
+		}
+	}
+}
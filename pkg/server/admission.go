@@ -0,0 +1,265 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// priority of a request waiting for inference; the interactive requests are admitted first
+type priority int
+
+const (
+	// page views
+	priorityInteractive priority = iota
+	// the api
+	priorityBatch
+	numPriorities
+)
+
+var priorityNames = []string{"interactive", "batch"}
+
+func (p priority) String() string {
+	return priorityNames[p]
+}
+
+// the page views are interactive, and the api is batch
+func priorityOf(r *http.Request) priority {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		return priorityBatch
+	}
+	return priorityInteractive
+}
+
+var (
+	admissionInflight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "admission_inflight",
+		Help: "Number of requests running inference",
+	})
+
+	admissionQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "admission_queued",
+		Help: "Number of requests waiting for inference, by priority",
+	}, []string{"priority"})
+
+	admissionRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "admission_rejected_total",
+		Help: "Number of requests rejected without inference, by priority and reason: queue_full or wait_timeout",
+	}, []string{"priority", "reason"})
+
+	admissionWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "admission_wait_millseconds",
+		Help:    "Time a request waits for inference, by priority",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 14),
+	}, []string{"priority"})
+)
+
+func init() {
+	prometheus.MustRegister(admissionInflight)
+	prometheus.MustRegister(admissionQueued)
+	prometheus.MustRegister(admissionRejected)
+	prometheus.MustRegister(admissionWait)
+}
+
+// admissionError rejects a request which is not admitted by the limiter
+type admissionError struct {
+	code       int
+	msg        string
+	retryAfter time.Duration
+}
+
+func (e *admissionError) Error() string {
+	return e.msg
+}
+
+// setRetryAfter tells the client when to retry, if the request is rejected by the limiter
+func setRetryAfter(w http.ResponseWriter, err error) {
+	if e, ok := err.(*admissionError); ok {
+		seconds := int((e.retryAfter + time.Second - 1) / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+}
+
+/*
+ limiter bounds the number of requests running inference; the others wait in a queue
+ for at most maxWait, and are admitted by priority, then first come first served.
+ A request is rejected with 429 if the queue is full, and with 503 if it waits too long.
+ The batch requests can fill at most half of the queue, rounded down, so that there is
+ always room for the interactive ones: with a queue of 1, only an interactive request can
+ wait, and with 0, no request waits. A nil limiter admits all the requests.
+*/
+type limiter struct {
+	maxInflight int
+	maxQueue    int
+	maxWait     time.Duration
+
+	lock     sync.Mutex
+	inflight int
+	// the waiters of each priority
+	queues [numPriorities]*list.List
+}
+
+type waiter struct {
+	// closed when the waiter is given a slot
+	ready chan struct{}
+}
+
+// limiterStats is the state of the limiter in /statusz
+type limiterStats struct {
+	MaxInflight int            `json:"max_inflight"`
+	MaxQueue    int            `json:"max_queue"`
+	Inflight    int            `json:"inflight"`
+	Queued      map[string]int `json:"queued"`
+}
+
+// newLimiter returns nil, i.e., no limit, if maxInflight is not positive.
+func newLimiter(maxInflight, maxQueue int, maxWait time.Duration) *limiter {
+	if maxInflight < 1 {
+		return nil
+	}
+	if maxQueue < 0 {
+		maxQueue = 0
+	}
+
+	l := &limiter{
+		maxInflight: maxInflight,
+		maxQueue:    maxQueue,
+		maxWait:     maxWait,
+	}
+	for i := range l.queues {
+		l.queues[i] = list.New()
+	}
+	return l
+}
+
+// acquire waits for a slot; the returned function releases it.
+func (l *limiter) acquire(ctx context.Context, p priority) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	begin := time.Now()
+	l.lock.Lock()
+	// a released slot is passed to a waiter, so a free slot means there is no waiter
+	if l.inflight < l.maxInflight {
+		l.inflight++
+		l.updateGauges()
+		l.lock.Unlock()
+		admissionWait.WithLabelValues(p.String()).Observe(0)
+		return l.release, nil
+	}
+
+	if !l.canQueue(p) {
+		l.lock.Unlock()
+		admissionRejected.WithLabelValues(p.String(), "queue_full").Inc()
+		return nil, &admissionError{
+			code:       http.StatusTooManyRequests,
+			msg:        fmt.Sprintf("server is busy: %d requests are waiting", l.maxQueue),
+			retryAfter: l.maxWait,
+		}
+	}
+
+	w := &waiter{ready: make(chan struct{})}
+	elem := l.queues[p].PushBack(w)
+	l.updateGauges()
+	l.lock.Unlock()
+
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		admissionWait.WithLabelValues(p.String()).Observe(time.Since(begin).Seconds() * 1000.0)
+		return l.release, nil
+	case <-timer.C:
+		admissionRejected.WithLabelValues(p.String(), "wait_timeout").Inc()
+		err = &admissionError{
+			code:       http.StatusServiceUnavailable,
+			msg:        fmt.Sprintf("server is busy: no slot in %v", l.maxWait),
+			retryAfter: l.maxWait,
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.lock.Lock()
+	select {
+	case <-w.ready:
+		// given a slot meanwhile, pass it on
+		l.lock.Unlock()
+		l.release()
+	default:
+		l.queues[p].Remove(elem)
+		l.updateGauges()
+		l.lock.Unlock()
+	}
+	return nil, err
+}
+
+func (l *limiter) release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, queue := range l.queues {
+		if front := queue.Front(); front != nil {
+			queue.Remove(front)
+			close(front.Value.(*waiter).ready)
+			l.updateGauges()
+			return
+		}
+	}
+	l.inflight--
+	l.updateGauges()
+}
+
+// canQueue tells whether a request of the priority can wait; the lock is held.
+// The batch requests are at most maxQueue/2, so none can wait if maxQueue < 2.
+func (l *limiter) canQueue(p priority) bool {
+	queued := 0
+	for _, queue := range l.queues {
+		queued += queue.Len()
+	}
+	if queued >= l.maxQueue {
+		return false
+	}
+	return p != priorityBatch || l.queues[p].Len() < l.maxQueue/2
+}
+
+// the lock is held
+func (l *limiter) updateGauges() {
+	admissionInflight.Set(float64(l.inflight))
+	for p, queue := range l.queues {
+		admissionQueued.WithLabelValues(priority(p).String()).Set(float64(queue.Len()))
+	}
+}
+
+func (l *limiter) stats() *limiterStats {
+	if l == nil {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	stats := &limiterStats{
+		MaxInflight: l.maxInflight,
+		MaxQueue:    l.maxQueue,
+		Inflight:    l.inflight,
+		Queued:      map[string]int{},
+	}
+	for p, queue := range l.queues {
+		stats.Queued[priority(p).String()] = queue.Len()
+	}
+	return stats
+}
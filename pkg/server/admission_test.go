@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until the number of waiting requests of the priority is n
+func waitQueued(t *testing.T, l *limiter, p priority, n int) {
+	for begin := time.Now(); time.Since(begin) < time.Second; time.Sleep(time.Millisecond) {
+		if l.stats().Queued[p.String()] == n {
+			return
+		}
+	}
+	t.Fatalf("got %d %v requests queued, want %d", l.stats().Queued[p.String()], p, n)
+}
+
+func TestLimiterQueueFull(t *testing.T) {
+	tests := []struct {
+		maxQueue int
+		// the number of requests which can wait; batch ones fill at most half of the queue
+		interactive int
+		batch       int
+	}{
+		{0, 0, 0},
+		{1, 1, 0},
+		{2, 2, 1},
+		{3, 3, 1},
+	}
+
+	for _, test := range tests {
+		for _, p := range []priority{priorityInteractive, priorityBatch} {
+			want := test.interactive
+			if p == priorityBatch {
+				want = test.batch
+			}
+
+			l := newLimiter(1, test.maxQueue, time.Minute)
+			release, _ := l.acquire(context.Background(), priorityInteractive)
+			ctx, cancel := context.WithCancel(context.Background())
+			for i := 0; i < want; i++ {
+				go l.acquire(ctx, p)
+				waitQueued(t, l, p, i+1)
+			}
+			if _, err := l.acquire(ctx, p); err == nil || err.(*admissionError).code != http.StatusTooManyRequests {
+				t.Errorf("maxQueue %d, %v request %d: got %v, want 429", test.maxQueue, p, want+1, err)
+			}
+			cancel()
+			release()
+		}
+	}
+}
+
+func TestLimiterPriority(t *testing.T) {
+	l := newLimiter(1, 4, time.Minute)
+	release, _ := l.acquire(context.Background(), priorityInteractive)
+
+	// the order in which the waiters are admitted
+	admitted := make(chan string, 3)
+	for _, waiter := range []struct {
+		name   string
+		p      priority
+		queued int
+	}{{"batch", priorityBatch, 1}, {"interactive-1", priorityInteractive, 1}, {"interactive-2", priorityInteractive, 2}} {
+		name := waiter.name
+		go func(p priority) {
+			release, err := l.acquire(context.Background(), p)
+			if err != nil {
+				admitted <- err.Error()
+				return
+			}
+			admitted <- name
+			release()
+		}(waiter.p)
+		waitQueued(t, l, waiter.p, waiter.queued)
+	}
+
+	release()
+	for _, want := range []string{"interactive-1", "interactive-2", "batch"} {
+		if got := <-admitted; got != want {
+			t.Errorf("got %v admitted, want %v", got, want)
+		}
+	}
+}
+
+func TestLimiterWaitTimeout(t *testing.T) {
+	l := newLimiter(1, 1, 10*time.Millisecond)
+	release, _ := l.acquire(context.Background(), priorityInteractive)
+	defer release()
+
+	if _, err := l.acquire(context.Background(), priorityInteractive); err == nil || err.(*admissionError).code != http.StatusServiceUnavailable {
+		t.Fatalf("got %v, want 503", err)
+	}
+	if queued := l.stats().Queued[priorityInteractive.String()]; queued != 0 {
+		t.Errorf("got %d queued after the timeout, want 0", queued)
+	}
+}
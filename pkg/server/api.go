@@ -0,0 +1,486 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	tfmodel "inceptionServer/pkg/model"
+	"inceptionServer/pkg/store"
+)
+
+const (
+	// max size of an uploaded image
+	maxUploadBytes = 10 << 20
+	defaultTopK    = 5
+	// default number of similar images to return
+	defaultSimilarK = 10
+	// default number of images returned by a label search
+	defaultLabelLimit = 100
+	// form field name of the multipart upload
+	uploadField = "image"
+)
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		glog.Errorf("Failed to encode json response: %v", err)
+	}
+}
+
+// get the number of labels to return from query parameter "k"
+func parseTopK(r *http.Request) (int, error) {
+	return parseK(r, defaultTopK)
+}
+
+func parseK(r *http.Request, def int) (int, error) {
+	v := r.URL.Query().Get("k")
+	if v == "" {
+		return def, nil
+	}
+
+	k, err := strconv.Atoi(v)
+	if err != nil || k < 1 {
+		return 0, fmt.Errorf("invalid k: %v", v)
+	}
+	return k, nil
+}
+
+// the client asks to bypass the prediction cache
+func noCache(r *http.Request) bool {
+	for _, v := range r.Header["Cache-Control"] {
+		if strings.Contains(strings.ToLower(v), "no-cache") {
+			return true
+		}
+	}
+	return false
+}
+
+// read the image from a multipart upload, or from the raw request body;
+// the errors are of kind KindInvalid, or KindTooLarge.
+func readUploadedImage(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	img, err := readUpload(w, r)
+	if err != nil {
+		// the error of http.MaxBytesReader
+		if strings.Contains(err.Error(), "request body too large") {
+			return nil, tfmodel.NewError(tfmodel.KindTooLarge, "image is larger than %d bytes", maxUploadBytes)
+		}
+		return nil, tfmodel.NewError(tfmodel.KindInvalid, "failed to read image: %v", err)
+	}
+	if len(img) < 1 {
+		return nil, tfmodel.NewError(tfmodel.KindInvalid, "empty image")
+	}
+	return img, nil
+}
+
+func readUpload(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+
+	ctype := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(ctype, "multipart/form-data") {
+		return ioutil.ReadAll(r.Body)
+	}
+
+	if err := r.ParseMultipartForm(maxUploadBytes); err != nil {
+		return nil, err
+	}
+
+	file, _, err := r.FormFile(uploadField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get form file %v: %v", uploadField, err)
+	}
+	defer file.Close()
+
+	return ioutil.ReadAll(io.LimitReader(file, maxUploadBytes))
+}
+
+// handle POST /api/v1/predict?model=<name>, and POST /api/v1/models/{name}/predict;
+// the default model is used if name is empty.
+func (s *InceptionServer) handleAPIPredict(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	begin := time.Now()
+	name, ok := params["name"]
+	if !ok {
+		name = r.URL.Query().Get("model")
+	}
+
+	model, err := s.models.Get(name)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	modelID := model.Info().ID
+
+	k, err := parseTopK(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	img, err := readUploadedImage(w, r)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+
+	result, hit, err := s.cache.PredictTopK(tfmodel.ImageID(img), model, k, noCache(r), func(model tfmodel.Classifier) (*tfmodel.PredictResult, error) {
+		release, err := s.limiter.acquire(r.Context(), priorityOf(r))
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return model.PredictTopK(r.Context(), img, k)
+	})
+	if err != nil {
+		glog.Errorf("Failed to predict uploaded image: %v", err)
+		s.metrics.AddPrediction(modelID, statusCode(err), time.Since(begin))
+		s.failAs(w, r, "prediction failed", err)
+		return
+	}
+	s.metrics.AddPrediction(modelID, http.StatusOK, time.Since(begin))
+
+	if hit {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+type embedResult struct {
+	Model     string    `json:"model"`
+	Op        string    `json:"op"`
+	Dim       int       `json:"dim"`
+	Embedding []float32 `json:"embedding"`
+}
+
+// the embedding is returned as little-endian float32s if "format=binary", or the client accepts octet-stream
+func wantBinary(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "binary" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/octet-stream")
+}
+
+// handle POST /api/v1/embed?model=<name>: returns the feature vector of the uploaded image
+func (s *InceptionServer) handleAPIEmbed(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	model, err := s.models.Get(r.URL.Query().Get("model"))
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+
+	embedder, ok := model.(tfmodel.Embedder)
+	if !ok {
+		s.fail(w, r, tfmodel.ErrNoEmbedding)
+		return
+	}
+
+	img, err := readUploadedImage(w, r)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+
+	release, err := s.limiter.acquire(r.Context(), priorityOf(r))
+	if err != nil {
+		s.failAs(w, r, "embedding failed", err)
+		return
+	}
+	vec, err := embedder.Embed(r.Context(), img)
+	release()
+	if err != nil {
+		glog.Errorf("Failed to embed uploaded image: %v", err)
+		s.failAs(w, r, "embedding failed", err)
+		return
+	}
+
+	if wantBinary(r) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Embedding-Dim", strconv.Itoa(len(vec)))
+		w.WriteHeader(http.StatusOK)
+		if err := binary.Write(w, binary.LittleEndian, vec); err != nil {
+			glog.Errorf("Failed to write embedding: %v", err)
+		}
+		return
+	}
+
+	info := model.Info()
+	writeJSON(w, http.StatusOK, &embedResult{
+		Model:     info.ID,
+		Op:        info.EmbeddingOp,
+		Dim:       len(vec),
+		Embedding: vec,
+	})
+}
+
+type imageResult struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// the matched label of a label search
+	Label string  `json:"label,omitempty"`
+	Score float32 `json:"score"`
+	URL   string  `json:"url"`
+}
+
+type labelSearchResult struct {
+	Label string `json:"label"`
+	// number of the matched images, which may be more than the returned ones
+	Total int `json:"total"`
+	// number of the images whose labels are predicted; the others are still being predicted
+	Indexed int            `json:"indexed"`
+	Images  []*imageResult `json:"images"`
+}
+
+// join the neighbours with the images in ImageDB; the images removed meanwhile are skipped.
+func (s *InceptionServer) imageResults(neighbors []*tfmodel.Neighbor) []*imageResult {
+	result := []*imageResult{}
+	for _, n := range neighbors {
+		img, err := s.imgDB.Get(n.ID)
+		if err != nil {
+			continue
+		}
+		result = append(result, &imageResult{
+			ID:    img.ID,
+			Name:  filepath.Base(img.Name),
+			Score: n.Score,
+			URL:   "/img/" + img.ID,
+		})
+	}
+	return result
+}
+
+// parse the query parameters "label", "min_score" and "limit" of a label search
+func parseLabelQuery(r *http.Request) (string, float32, int, error) {
+	query := r.URL.Query()
+	label := strings.TrimSpace(query.Get("label"))
+	if label == "" {
+		return "", 0, 0, fmt.Errorf("label is required")
+	}
+
+	minScore := float32(0)
+	if v := query.Get("min_score"); v != "" {
+		f, err := strconv.ParseFloat(v, 32)
+		if err != nil || f < 0 || f > 1 {
+			return "", 0, 0, fmt.Errorf("invalid min_score: %v", v)
+		}
+		minScore = float32(f)
+	}
+
+	limit := defaultLabelLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return "", 0, 0, fmt.Errorf("invalid limit: %v", v)
+		}
+		limit = n
+	}
+
+	return label, minScore, limit, nil
+}
+
+// search the images by predicted label; the matched label is kept
+func (s *InceptionServer) searchLabel(label string, minScore float32, limit int) *labelSearchResult {
+	matches := s.labelIndex.Search(label, minScore)
+	result := &labelSearchResult{
+		Label:   label,
+		Total:   len(matches),
+		Indexed: s.labelIndex.Size(),
+		Images:  []*imageResult{},
+	}
+
+	for _, m := range matches {
+		if len(result.Images) >= limit {
+			break
+		}
+		img, err := s.imgDB.Get(m.ID)
+		if err != nil {
+			continue
+		}
+		result.Images = append(result.Images, &imageResult{
+			ID:    img.ID,
+			Name:  filepath.Base(img.Name),
+			Label: m.Label,
+			Score: m.Score,
+			URL:   "/img/" + img.ID,
+		})
+	}
+	return result
+}
+
+// handle GET /api/v1/images?label=<prefix>&min_score=<score>&limit=<n>
+func (s *InceptionServer) handleAPIImages(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if s.labelIndex == nil {
+		s.writeError(w, r, http.StatusServiceUnavailable, "label index is not available")
+		return
+	}
+
+	label, minScore, limit, err := parseLabelQuery(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.searchLabel(label, minScore, limit))
+}
+
+// handle POST /api/v1/search?k=<k>: returns the images which look like the uploaded one
+func (s *InceptionServer) handleAPISearch(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	k, err := parseK(r, defaultSimilarK)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	img, err := readUploadedImage(w, r)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+
+	release, err := s.limiter.acquire(r.Context(), priorityOf(r))
+	if err != nil {
+		s.failAs(w, r, "search failed", err)
+		return
+	}
+	neighbors, err := s.imgDB.Search(r.Context(), img, k)
+	release()
+	if err != nil {
+		glog.Errorf("Failed to search similar images: %v", err)
+		s.failAs(w, r, "search failed", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.imageResults(neighbors))
+}
+
+// handle GET /api/v1/models
+func (s *InceptionServer) handleAPIListModels(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	writeJSON(w, http.StatusOK, s.models.Infos())
+}
+
+// reloadStatus is the response of a reload request
+type reloadStatus struct {
+	Model  string `json:"model"`
+	Status string `json:"status"`
+}
+
+// handle POST /api/v1/models/{name}/reload: reload the model from its dir in the background, and return 202;
+// the old version keeps serving if the reload fails. It is 403 unless the reload api is enabled.
+func (s *InceptionServer) handleAPIReload(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !s.reloadAPI {
+		s.writeError(w, r, http.StatusForbidden, "reload api is disabled")
+		return
+	}
+
+	name := params["name"]
+	model, err := s.models.Get(name)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	reloader, ok := model.(tfmodel.Reloader)
+	if !ok {
+		s.fail(w, r, tfmodel.NewError(tfmodel.KindNotImplemented, "model %v can not be reloaded", name))
+		return
+	}
+	if reloader.Reloading() {
+		s.writeError(w, r, http.StatusConflict, fmt.Sprintf("model %v is reloading", name))
+		return
+	}
+
+	go func() {
+		if err := reloader.Reload(); err != nil {
+			glog.Errorf("Failed to reload model %v: %v", name, err)
+		}
+	}()
+	writeJSON(w, http.StatusAccepted, &reloadStatus{Model: name, Status: "reloading"})
+}
+
+// parse a time of the query: RFC3339, or a date
+func parseTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+func parseRecordQuery(r *http.Request) (*store.Query, error) {
+	query := r.URL.Query()
+	q := &store.Query{
+		Hash:  query.Get("hash"),
+		Path:  query.Get("path"),
+		Label: strings.TrimSpace(query.Get("label")),
+		Limit: defaultLabelLimit,
+	}
+
+	if v := query.Get("min_score"); v != "" {
+		f, err := strconv.ParseFloat(v, 32)
+		if err != nil || f < 0 || f > 1 {
+			return nil, fmt.Errorf("invalid min_score: %v", v)
+		}
+		q.MinScore = float32(f)
+	}
+
+	if v := query.Get("from"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from: %v", v)
+		}
+		q.From = t
+	}
+
+	if v := query.Get("to"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid to: %v", v)
+		}
+		q.To = t
+	}
+
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid limit: %v", v)
+		}
+		q.Limit = n
+	}
+
+	return q, nil
+}
+
+// handle GET /api/v1/records?hash=&path=&label=&min_score=&from=&to=&limit=: query the stored images
+func (s *InceptionServer) handleAPIRecords(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if s.store == nil {
+		s.writeError(w, r, http.StatusServiceUnavailable, "store is not enabled")
+		return
+	}
+
+	q, err := parseRecordQuery(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	records, err := s.store.Query(q)
+	if err != nil {
+		glog.Errorf("Failed to query store: %v", err)
+		s.writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("query failed: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, records)
+}
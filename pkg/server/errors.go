@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+
+	tfmodel "inceptionServer/pkg/model"
+)
+
+// the status of the requests whose client is gone, as nginx logs it; the client never sees it
+const statusClientClosed = 499
+
+var errorPageTemplate = template.Must(template.New("error").Parse(`
+	<p style="font-size:20px">{{.Code}} {{.Status}}</p>
+	<p>{{.Message}}</p>
+	<a href="/">Home</a>
+	`))
+
+// statusCode returns the http status of an error of pkg/model, or of the limiter
+func statusCode(err error) int {
+	if e, ok := err.(*admissionError); ok {
+		return e.code
+	}
+
+	switch tfmodel.KindOf(err) {
+	case tfmodel.KindInvalid:
+		return http.StatusBadRequest
+	case tfmodel.KindNotFound:
+		return http.StatusNotFound
+	case tfmodel.KindTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case tfmodel.KindUnsupported:
+		return http.StatusUnsupportedMediaType
+	case tfmodel.KindNotImplemented:
+		return http.StatusNotImplemented
+	case tfmodel.KindUnavailable:
+		return http.StatusServiceUnavailable
+	case tfmodel.KindTimeout:
+		return http.StatusGatewayTimeout
+	case tfmodel.KindCanceled:
+		return statusClientClosed
+	}
+	return http.StatusInternalServerError
+}
+
+// the errors of the api, and of the clients which accept json, are json
+func wantJSON(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeError writes the error as json or as an html page, whichever the client wants.
+func (s *InceptionServer) writeError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	if code >= http.StatusInternalServerError {
+		glog.Errorf("%v %v: %d %v", r.Method, r.URL.Path, code, msg)
+	} else {
+		glog.V(3).Infof("%v %v: %d %v", r.Method, r.URL.Path, code, msg)
+	}
+
+	if wantJSON(r) {
+		writeJSON(w, code, &apiError{Error: msg})
+		return
+	}
+
+	head, err := getHead("Error", "Error")
+	if err != nil {
+		http.Error(w, msg, code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	io.WriteString(w, head)
+	data := map[string]interface{}{"Code": code, "Status": http.StatusText(code), "Message": msg}
+	if err := errorPageTemplate.Execute(w, data); err != nil {
+		glog.Errorf("Failed to execute template: %v", err)
+	}
+	io.WriteString(w, s.genPageFoot(r))
+}
+
+// fail writes the error with the status of its kind
+func (s *InceptionServer) fail(w http.ResponseWriter, r *http.Request, err error) {
+	setRetryAfter(w, err)
+	s.writeError(w, r, statusCode(err), err.Error())
+}
+
+// failAs is fail with the message prefixed by what failed, e.g., "prediction failed"
+func (s *InceptionServer) failAs(w http.ResponseWriter, r *http.Request, what string, err error) {
+	setRetryAfter(w, err)
+	s.writeError(w, r, statusCode(err), fmt.Sprintf("%v: %v", what, err))
+}
+
+func (s *InceptionServer) notFound(w http.ResponseWriter, r *http.Request) {
+	s.writeError(w, r, http.StatusNotFound, fmt.Sprintf("%v is not found", r.URL.Path))
+}
+
+func (s *InceptionServer) methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed []string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	s.writeError(w, r, http.StatusMethodNotAllowed, fmt.Sprintf("%v is not allowed, only %v", r.Method, strings.Join(allowed, ", ")))
+}
+
+// statusWriter records the status code of the response
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// the status of the response; 200 if nothing is written
+func (w *statusWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
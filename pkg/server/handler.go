@@ -12,6 +12,12 @@ import (
 	"strings"
 )
 
+const (
+	// number of thumbnails under the predictions
+	similarStripSize = 5
+	// number of thumbnails in a row of the grid
+	gridColumns = 5
+)
 
 var (
 	htmlHeadTemplate string = `
@@ -35,19 +41,42 @@ var (
 
 	tableImgTemplate string = `
 	<table>
-	  <tr><td><img style="width:250px;height:260px" src="data:image/jpg;base64,{{.Image}}"></td></tr>
-	  <tr><td align="center">{{.ImageName}}</td></tr>
+	  <tr><td><img style="width:250px;height:260px" src="data:{{.MIME}};base64,{{.Image}}"></td></tr>
+	  <tr><td align="center"><a href="/img/{{.ImageID}}">{{.ImageName}}</a></td></tr>
 	 </table>`
 
 
+	modelLinksTemplate string = `
+	<br/>Models:{{range .Names}}
+	{{if eq . $.Current}}<b>{{.}}</b>{{else}}<a href="/img/{{$.ImageID}}?model={{.}}">{{.}}</a>{{end}}{{end}}
+	`
+
+	similarStripTemplate string = `
+	<br/>Similar images: <a href="/img/{{.ImageID}}/similar">more</a><br/>
+	{{range .Images}}<a href="{{.URL}}"><img style="width:100px;height:100px" src="{{.URL}}/raw" title="{{.Name}} ({{printf "%.3f" .Score}})"></a>
+	{{end}}`
+
+	imageGridTemplate string = `
+	<table>{{range .Rows}}
+	  <tr>{{range .}}<td align="center"><a href="{{.URL}}"><img style="width:200px;height:180px" src="{{.URL}}/raw"></a><br/>
+	  {{.Name}} ({{if .Label}}{{.Label}}: {{end}}{{printf "%.3f" .Score}})</td>{{end}}</tr>{{end}}
+	</table>`
+
+	labelSearchTemplate string = `
+	<form action="/search" method="get">
+	  <input type="text" name="label" value="{{.Label}}" placeholder="label, e.g., golden retriever">
+	  min score: <input type="text" name="min_score" value="{{.MinScore}}" size="5">
+	  <input type="submit" value="Search">
+	</form>`
+
 	imageTemplate string = `<!DOCTYPE html>
 <html lang="en"><head></head>
-<body><center><img src="data:image/jpg;base64,{{.Image}}"></center></body>`
+<body><center><img src="data:{{.MIME}};base64,{{.Image}}"></center></body>`
 
 	smallImageTemplate string = `<!DOCTYPE html>
 <html lang="en"><head></head>
 <body><center><table>
-	  <tr><td><img style="width:200px;height:180px" src="data:image/jpg;base64,{{.Image}}"></td></tr>
+	  <tr><td><img style="width:200px;height:180px" src="data:{{.MIME}};base64,{{.Image}}"></td></tr>
 	  <tr><td>{{.ImageName}}</td></tr></table>
       </center></body>`
 )
@@ -75,7 +104,7 @@ func getHead(title string, head string) (string, error) {
 	return result.String(), nil
 }
 
-func getImgTable(fpath string, img []byte) string {
+func getImgTable(id, fpath, mime string, img []byte) string {
 	str := base64.StdEncoding.EncodeToString(img)
 	tmp, err := template.New("image").Parse(tableImgTemplate)
 	if err != nil {
@@ -85,7 +114,7 @@ func getImgTable(fpath string, img []byte) string {
 
 	var table bytes.Buffer
 	fname := filepath.Base(fpath)
-	data := map[string]interface{}{"Image": str, "ImageName": fname}
+	data := map[string]interface{}{"Image": str, "ImageName": fname, "ImageID": id, "MIME": mime}
 	if err := tmp.Execute(&table, data); err != nil {
 		glog.Errorf("Faile to execute template: %v", err)
 		return ""
@@ -94,6 +123,99 @@ func getImgTable(fpath string, img []byte) string {
 	return table.String()
 }
 
+// links to show the predictions of the image by the other models
+func getModelLinks(id, current string, names []string) string {
+	if len(names) < 2 {
+		return ""
+	}
+
+	tmp, err := template.New("models").Parse(modelLinksTemplate)
+	if err != nil {
+		glog.Errorf("Failed to parse model links template %v:%v", modelLinksTemplate, err)
+		return ""
+	}
+
+	var result bytes.Buffer
+	data := map[string]interface{}{"ImageID": id, "Current": current, "Names": names}
+	if err := tmp.Execute(&result, data); err != nil {
+		glog.Errorf("Faile to execute template: %v", err)
+		return ""
+	}
+
+	return result.String()
+}
+
+// a strip of thumbnails under the predictions
+func getSimilarStrip(id string, images []*imageResult) string {
+	if len(images) < 1 {
+		return ""
+	}
+
+	tmp, err := template.New("similar").Parse(similarStripTemplate)
+	if err != nil {
+		glog.Errorf("Failed to parse similar strip template %v:%v", similarStripTemplate, err)
+		return ""
+	}
+
+	var result bytes.Buffer
+	data := map[string]interface{}{"ImageID": id, "Images": images}
+	if err := tmp.Execute(&result, data); err != nil {
+		glog.Errorf("Faile to execute template: %v", err)
+		return ""
+	}
+
+	return result.String()
+}
+
+// a grid of thumbnails, gridColumns in a row
+func getImageGrid(images []*imageResult) string {
+	if len(images) < 1 {
+		return "<br/>No image found.<br/>"
+	}
+
+	rows := [][]*imageResult{}
+	for i := 0; i < len(images); i += gridColumns {
+		end := i + gridColumns
+		if end > len(images) {
+			end = len(images)
+		}
+		rows = append(rows, images[i:end])
+	}
+
+	tmp, err := template.New("grid").Parse(imageGridTemplate)
+	if err != nil {
+		glog.Errorf("Failed to parse similar grid template %v:%v", imageGridTemplate, err)
+		return ""
+	}
+
+	var result bytes.Buffer
+	data := map[string]interface{}{"Rows": rows}
+	if err := tmp.Execute(&result, data); err != nil {
+		glog.Errorf("Faile to execute template: %v", err)
+		return ""
+	}
+
+	return result.String()
+}
+
+// the search box for the predicted labels
+func getLabelSearchBox(label string, minScore float32) string {
+	tmp, err := template.New("search").Parse(labelSearchTemplate)
+	if err != nil {
+		glog.Errorf("Failed to parse label search template %v:%v", labelSearchTemplate, err)
+		return ""
+	}
+
+	var result bytes.Buffer
+	data := map[string]interface{}{"Label": label, "MinScore": minScore}
+	if err := tmp.Execute(&result, data); err != nil {
+		glog.Errorf("Faile to execute template: %v", err)
+		return ""
+	}
+
+	return result.String()
+}
+
 func getClientIP(r *http.Request) string {
 	return r.RemoteAddr
 }
@@ -110,14 +232,14 @@ func getOriginalClientInfo(r *http.Request) string {
 	return ""
 }
 
-func GetImgHtml(fname string, img []byte, predict, foot string, begin time.Time) string {
+func GetImgHtml(id, fname, mime string, img []byte, predict, foot string, begin time.Time) string {
 	head, err := getHead("ShowImage", "Image details")
 	if err != nil {
 		glog.Errorf("Failed to get head: %v", err)
 		return ""
 	}
 
-	table := getImgTable(fname, img)
+	table := getImgTable(id, fname, mime, img)
 	if table == "" {
 		glog.Errorf("Failed to get image.")
 		return ""
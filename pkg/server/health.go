@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+
+	tfmodel "inceptionServer/pkg/model"
+)
+
+// modelStatus is a loaded model in /statusz
+type modelStatus struct {
+	*tfmodel.ModelInfo
+	Reloading bool `json:"reloading"`
+}
+
+// serverStatus is the json of /statusz
+type serverStatus struct {
+	Version       string                `json:"version"`
+	GoVersion     string                `json:"go_version"`
+	Host          string                `json:"host"`
+	StartedAt     time.Time             `json:"started_at"`
+	UptimeSeconds float64               `json:"uptime_seconds"`
+	Ready         bool                  `json:"ready"`
+	NotReady      []string              `json:"not_ready,omitempty"`
+	Models        []*modelStatus        `json:"models"`
+	Images        int                   `json:"images"`
+	LabelIndexed  int                   `json:"label_indexed"`
+	Cache         *tfmodel.CacheStats   `json:"cache"`
+	Admission     *limiterStats         `json:"admission,omitempty"`
+	Store         bool                  `json:"store"`
+}
+
+/*
+ WarmUp checks every model with a smoke prediction; the server is not ready until it succeeds.
+ It is called in the background at startup, so that /healthz is served in the meanwhile.
+*/
+func (s *InceptionServer) WarmUp() error {
+	begin := time.Now()
+	if err := s.models.Verify(); err != nil {
+		s.setWarmUpError(err)
+		return fmt.Errorf("warm-up prediction failed: %v", err)
+	}
+
+	s.setWarmUpError(nil)
+	atomic.StoreInt32(&s.warm, 1)
+	glog.V(2).Infof("Warmed up the models in %v", time.Since(begin))
+	return nil
+}
+
+func (s *InceptionServer) setWarmUpError(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.warmUpErr = err
+}
+
+// drain makes the server not ready, and waits for shutdownDelay so that the load balancers stop sending requests.
+func (s *InceptionServer) drain(ctx context.Context) {
+	atomic.StoreInt32(&s.draining, 1)
+	if s.shutdownDelay <= 0 {
+		return
+	}
+
+	glog.V(1).Infof("Not ready, keep serving for %v before shutting down", s.shutdownDelay)
+	select {
+	case <-time.After(s.shutdownDelay):
+	case <-ctx.Done():
+	}
+}
+
+// notReady returns why the server is not ready; empty if it is ready.
+func (s *InceptionServer) notReady() []string {
+	result := []string{}
+	if atomic.LoadInt32(&s.draining) == 1 {
+		result = append(result, "shutting down")
+	}
+	if s.models.Default() == nil {
+		result = append(result, "no model is loaded")
+	}
+	if atomic.LoadInt32(&s.warm) == 0 {
+		s.lock.Lock()
+		err := s.warmUpErr
+		s.lock.Unlock()
+		if err != nil {
+			result = append(result, fmt.Sprintf("warm-up prediction failed: %v", err))
+		} else {
+			result = append(result, "warm-up prediction is not done")
+		}
+	}
+	for _, name := range s.models.Reloading() {
+		result = append(result, fmt.Sprintf("model %v is reloading", name))
+	}
+	if s.imgDB == nil || s.imgDB.Size() < 1 {
+		result = append(result, "no image is loaded")
+	}
+	return result
+}
+
+// handle /healthz: the process is alive
+func (s *InceptionServer) handleHealthz(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "ok\n")
+}
+
+// handle /readyz: 200 if the server can serve predictions, else 503 with the reasons
+func (s *InceptionServer) handleReadyz(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	reasons := s.notReady()
+	if len(reasons) > 0 {
+		glog.V(3).Infof("Not ready: %v", strings.Join(reasons, "; "))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, strings.Join(reasons, "\n") + "\n")
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// handle /statusz: the state of the server as json
+func (s *InceptionServer) handleStatusz(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	reloading := map[string]bool{}
+	for _, name := range s.models.Reloading() {
+		reloading[name] = true
+	}
+
+	status := &serverStatus{
+		Version:       s.version,
+		GoVersion:     runtime.Version(),
+		Host:          s.host,
+		StartedAt:     s.started,
+		UptimeSeconds: time.Since(s.started).Seconds(),
+		NotReady:      s.notReady(),
+		Models:        []*modelStatus{},
+		Cache:         s.cache.Stats(),
+		Admission:     s.limiter.stats(),
+		Store:         s.store != nil,
+	}
+	status.Ready = len(status.NotReady) == 0
+	for _, name := range s.models.Names() {
+		m, err := s.models.Get(name)
+		if err != nil {
+			continue
+		}
+		status.Models = append(status.Models, &modelStatus{ModelInfo: m.Info(), Reloading: reloading[name]})
+	}
+	if s.imgDB != nil {
+		status.Images = s.imgDB.Size()
+	}
+	if s.labelIndex != nil {
+		status.LabelIndexed = s.labelIndex.Size()
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// handlerFunc handles a request; params are the values of the {name} segments of the pattern.
+type handlerFunc func(w http.ResponseWriter, r *http.Request, params map[string]string)
+
+type route struct {
+	method string
+	// segments of the path pattern; "{name}" matches any one segment
+	segments []string
+	handler  handlerFunc
+}
+
+/*
+ router dispatches the requests by method and path pattern, e.g., "GET /img/{id}/raw".
+ A path matching no pattern is 404, and a path matching only the patterns of other
+ methods is 405; HEAD requests are handled by the GET handlers.
+*/
+type router struct {
+	routes []*route
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+func (rt *router) handle(method, pattern string, handler handlerFunc) {
+	rt.routes = append(rt.routes, &route{
+		method:   method,
+		segments: splitPath(pattern),
+		handler:  handler,
+	})
+}
+
+// match returns the params of the path; false if the path does not match.
+func (rt *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rt.segments) {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for i, seg := range rt.segments {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[seg[1:len(seg)-1]] = segments[i]
+			continue
+		}
+		if seg != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// find returns the handler of the request and its params, or the methods allowed for the path if no handler matches.
+func (rt *router) find(r *http.Request) (handlerFunc, map[string]string, []string) {
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+
+	segments := splitPath(r.URL.Path)
+	allowed := []string{}
+	for _, route := range rt.routes {
+		params, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		if route.method == method {
+			return route.handler, params, nil
+		}
+		allowed = appendMethod(allowed, route.method)
+		if route.method == http.MethodGet {
+			allowed = appendMethod(allowed, http.MethodHead)
+		}
+	}
+
+	sort.Strings(allowed)
+	return nil, nil, allowed
+}
+
+// appendMethod appends the method if it is not in methods yet
+func appendMethod(methods []string, method string) []string {
+	for _, m := range methods {
+		if m == method {
+			return methods
+		}
+	}
+	return append(methods, method)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRouterFind(t *testing.T) {
+	rt := &router{}
+	// the handler tells which route is found
+	found := ""
+	handler := func(name string) handlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+			found = name
+		}
+	}
+	rt.handle(http.MethodGet, "/", handler("root"))
+	rt.handle(http.MethodGet, "/img/random", handler("random"))
+	rt.handle(http.MethodGet, "/img/{id}", handler("image"))
+	rt.handle(http.MethodGet, "/img/{id}/raw", handler("raw"))
+	rt.handle(http.MethodPost, "/api/v1/predict", handler("predict"))
+	rt.handle(http.MethodPut, "/api/v1/predict", handler("put"))
+	rt.handle(http.MethodPost, "/api/v1/models/{name}/predict", handler("model"))
+
+	tests := []struct {
+		method  string
+		path    string
+		route   string
+		params  map[string]string
+		allowed []string
+	}{
+		{"GET", "/", "root", map[string]string{}, nil},
+		{"HEAD", "/", "root", map[string]string{}, nil},
+		// the static segment is matched by the first route
+		{"GET", "/img/random", "random", map[string]string{}, nil},
+		{"GET", "/img/abc", "image", map[string]string{"id": "abc"}, nil},
+		{"GET", "/img/abc/", "image", map[string]string{"id": "abc"}, nil},
+		{"HEAD", "/img/abc/raw", "raw", map[string]string{"id": "abc"}, nil},
+		{"POST", "/api/v1/models/inception/predict", "model", map[string]string{"name": "inception"}, nil},
+		{"GET", "/img/abc/similar", "", nil, []string{}},
+		{"GET", "/img//raw", "", nil, []string{}},
+		{"GET", "/unknown", "", nil, []string{}},
+		// /img/random matches both the GET routes, which are listed once
+		{"POST", "/img/random", "", nil, []string{"GET", "HEAD"}},
+		{"GET", "/api/v1/predict", "", nil, []string{"POST", "PUT"}},
+		{"DELETE", "/api/v1/models/inception/predict", "", nil, []string{"POST"}},
+	}
+
+	for _, test := range tests {
+		found = ""
+		r := httptest.NewRequest(test.method, test.path, nil)
+		h, params, allowed := rt.find(r)
+		if h != nil {
+			h(nil, r, params)
+		}
+
+		if found != test.route {
+			t.Errorf("%v %v: got route %q, want %q", test.method, test.path, found, test.route)
+		}
+		if !reflect.DeepEqual(params, test.params) {
+			t.Errorf("%v %v: got params %v, want %v", test.method, test.path, params, test.params)
+		}
+		if !reflect.DeepEqual(allowed, test.allowed) {
+			t.Errorf("%v %v: got allowed %v, want %v", test.method, test.path, allowed, test.allowed)
+		}
+	}
+}
@@ -1,18 +1,21 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"time"
+	"net"
 	"net/http"
 	"html/template"
+	"sync"
 	"github.com/golang/glog"
 
 	"inceptionServer/pkg/util"
 	tfmodel "inceptionServer/pkg/model"
+	"inceptionServer/pkg/store"
 	"bytes"
 	"os"
-	"strings"
 )
 
 
@@ -22,11 +25,36 @@ type InceptionServer struct {
 	host string
 	metrics *util.ServerMetrics
 
-	model *tfmodel.TfModel
+	models *tfmodel.Registry
 	imgDB *tfmodel.ImageDB
+	labelIndex *tfmodel.LabelIndex
+	cache *tfmodel.PredictCache
+	// nil if the store is not enabled
+	store *store.BoltStore
+
+	router *router
+	server *http.Server
+
+	// the build version shown in /statusz
+	version string
+	started time.Time
+	// how long to keep serving with /readyz failing before the shutdown
+	shutdownDelay time.Duration
+	// deadline of the requests; 0 for no deadline
+	requestTimeout time.Duration
+	// bounds the requests running inference; nil for no limit
+	limiter *limiter
+	// whether POST /api/v1/models/{name}/reload is allowed
+	reloadAPI bool
+
+	// 1 after the warm-up prediction succeeded, and when draining for the shutdown
+	warm int32
+	draining int32
+	lock sync.Mutex
+	warmUpErr error
 }
 
-func NewInceptionServer(port int, m *tfmodel.TfModel) *InceptionServer {
+func NewInceptionServer(port int, models *tfmodel.Registry) *InceptionServer {
 	ip, err := util.ExternalIP()
 	if err != nil {
 		glog.Errorf("Failed to get server IP: %v", err)
@@ -41,17 +69,27 @@ func NewInceptionServer(port int, m *tfmodel.TfModel) *InceptionServer {
 	glog.V(2).Infof("Will server on %s:%d", ip, port)
 
 
-	return &InceptionServer{
+	s := &InceptionServer{
 		port: port,
 		ip: ip,
 		host: host,
 		metrics: util.NewMetrics(),
-		model: m,
+		models: models,
+		version: "unknown",
+		started: time.Now(),
 	}
+	s.router = s.routes()
+	s.server = &http.Server{
+		Addr: fmt.Sprintf(":%d", port),
+		Handler: s,
+	}
+	return s
 }
 
 func (s *InceptionServer) Print() {
-	fmt.Printf("Number of labels: %d\n", len(s.model.Labels))
+	for _, info := range s.models.Infos() {
+		fmt.Printf("Model %v: number of labels: %d\n", info.ID, info.NumLabels)
+	}
 	s.imgDB.Print()
 }
 
@@ -59,26 +97,107 @@ func (s *InceptionServer) SetImages(imgs *tfmodel.ImageDB) {
 	s.imgDB = imgs
 }
 
-func (s *InceptionServer) Run() {
-	server := http.Server {
-		Addr: fmt.Sprintf(":%d", s.port),
-		Handler: s,
-	}
+func (s *InceptionServer) SetCache(cache *tfmodel.PredictCache) {
+	s.cache = cache
+}
+
+func (s *InceptionServer) SetStore(st *store.BoltStore) {
+	s.store = st
+}
+
+func (s *InceptionServer) SetLabelIndex(idx *tfmodel.LabelIndex) {
+	s.labelIndex = idx
+}
+
+func (s *InceptionServer) SetVersion(version string) {
+	s.version = version
+}
+
+// SetShutdownDelay sets how long Shutdown keeps serving with /readyz failing, before it stops accepting connections.
+func (s *InceptionServer) SetShutdownDelay(delay time.Duration) {
+	s.shutdownDelay = delay
+}
+
+// SetRequestTimeout sets the deadline of each request; the requests exceeding it get 504.
+func (s *InceptionServer) SetRequestTimeout(timeout time.Duration) {
+	s.requestTimeout = timeout
+}
 
-	glog.V(1).Infof("HTTP Server listens on: %s", server.Addr)
-	panic(server.ListenAndServe())
+// EnableReloadAPI allows anyone who can reach the server to reload the models over http.
+func (s *InceptionServer) EnableReloadAPI(enabled bool) {
+	s.reloadAPI = enabled
 }
 
-func (s *InceptionServer) doPredict(fname string) (string, error) {
-	tensor, err := s.imgDB.GetTensor(fname)
+/*
+ SetConcurrencyLimit bounds the number of requests running inference to maxInflight;
+ at most maxQueue requests wait for maxWait, the page views before the api requests.
+ There is no limit if maxInflight is not positive.
+*/
+func (s *InceptionServer) SetConcurrencyLimit(maxInflight, maxQueue int, maxWait time.Duration) {
+	s.limiter = newLimiter(maxInflight, maxQueue, maxWait)
+}
+
+// Run listens on the port, and serves until Shutdown is called; it returns nil after Shutdown.
+func (s *InceptionServer) Run() error {
+	listener, err := net.Listen("tcp", s.server.Addr)
 	if err != nil {
-		glog.Errorf("Failed to get tensor for %v: %v", err, fname)
-		return "", err
+		return err
 	}
+	return s.Serve(listener)
+}
+
+// Serve serves on the listener until Shutdown is called, e.g., on a random port for tests.
+func (s *InceptionServer) Serve(listener net.Listener) error {
+	glog.V(1).Infof("HTTP Server listens on: %s", listener.Addr())
+	if err := s.server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+/*
+ Shutdown makes /readyz fail, and keeps serving for the shutdown delay if it is set;
+ then it stops accepting connections, and waits for the requests in flight until
+ ctx is done; then the remaining connections are closed, and ctx.Err() is returned.
+ The models, images and store are not closed, they are owned by the caller.
+*/
+func (s *InceptionServer) Shutdown(ctx context.Context) error {
+	s.drain(ctx)
+	glog.V(1).Infof("Shutting down HTTP server on %s", s.server.Addr)
+	if err := s.server.Shutdown(ctx); err != nil {
+		glog.Warningf("Failed to drain the requests in flight: %v", err)
+		s.server.Close()
+		return err
+	}
+	return nil
+}
 
-	result, err := s.model.PredictTopKTensor(tensor, 5)
+func (s *InceptionServer) doPredict(r *http.Request, img *tfmodel.Image, model tfmodel.Classifier) (string, error) {
+	// the images are preprocessed by the model of ImageDB only
+	preprocessed := model == s.imgDB.Model()
+	result, _, err := s.cache.PredictTopK(img.ID, model, 5, noCache(r), func(model tfmodel.Classifier) (*tfmodel.PredictResult, error) {
+		release, err := s.limiter.acquire(r.Context(), priorityOf(r))
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		if preprocessed {
+			input, err := s.imgDB.GetInput(r.Context(), model, img.ID)
+			if err != nil {
+				return nil, err
+			}
+			return model.PredictTopKInput(r.Context(), input, 5)
+		}
+
+		bytes, err := s.imgDB.Bytes(img)
+		if err != nil {
+			return nil, err
+		}
+		return model.PredictTopK(r.Context(), bytes, 5)
+	})
 	if err != nil {
-		glog.Errorf("Failed to predict image %v: %v", fname, err)
+		glog.Errorf("Failed to predict image %v(%v): %v", img.ID, img.Name, err)
 		return "", err
 	}
 
@@ -86,17 +205,20 @@ func (s *InceptionServer) doPredict(fname string) (string, error) {
 }
 
 // handle pages "/", "/index.html", "index.htm"
-func (s *InceptionServer) handleWelcome(w http.ResponseWriter, r *http.Request) {
+func (s *InceptionServer) handleWelcome(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	head, err := getHead("Welcome", "Introduction")
 	if err != nil {
-		glog.Errorf("Failed to handle welcome page.")
-		io.WriteString(w, "Internal Error")
+		s.fail(w, r, err)
 		return
 	}
 
 	body := `This is a web server, which can assign labels to images using tensorflow inception model. <br/>
 	<a href="/img/random">Try it.</a>
-	It will show a random image, and its labels.`
+	It will show a random image, and its labels. <br/>
+	Images can also be classified by POSTing them to <code>/api/v1/predict</code>.`
+	if s.labelIndex != nil {
+		body += "<br/><br/>Search the images by predicted label:" + getLabelSearchBox("", 0)
+	}
 
 	foot := s.genPageFoot(r)
 
@@ -104,67 +226,181 @@ func (s *InceptionServer) handleWelcome(w http.ResponseWriter, r *http.Request)
 	return
 }
 
-// select a image by the requesting path
-func (s *InceptionServer) handlePredictPath(w http.ResponseWriter, r *http.Request) {
-	glog.V(4).Infof("Begin to handle predict request: %v", r.URL.Path)
+// handle page "/search?label=<prefix>&min_score=<score>": a grid of the images with the label
+func (s *InceptionServer) handleLabelSearch(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if s.labelIndex == nil {
+		s.writeError(w, r, http.StatusServiceUnavailable, "label index is not available")
+		return
+	}
+
+	label, minScore, limit, err := parseLabelQuery(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	head, err := getHead("SearchImages", "Images labeled as " + label)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+
+	result := s.searchLabel(label, minScore, limit)
+	summary := fmt.Sprintf("<br/>%d images found, %d shown; labels of %d images are predicted.<br/>",
+		result.Total, len(result.Images), result.Indexed)
+	body := getLabelSearchBox(label, minScore) + summary + getImageGrid(result.Images)
+
+	io.WriteString(w, head + body + s.genPageFoot(r))
+}
+
+// the image of path /img/{id}
+func (s *InceptionServer) getImage(w http.ResponseWriter, r *http.Request, params map[string]string) (*tfmodel.Image, bool) {
+	img, err := s.imgDB.Get(params["id"])
+	if err != nil {
+		s.fail(w, r, err)
+		return nil, false
+	}
+	return img, true
+}
+
+// handle page /img/{id}: the image and its predicted labels
+func (s *InceptionServer) handleImage(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	begin := time.Now()
+	if img, ok := s.getImage(w, r, params); ok {
+		s.handlePredict(w, r, img, begin)
+	}
+}
 
-	idx := util.StringToInt(r.URL.Path)
-	glog.V(3).Infof("generate index(%d) for path: %v", idx, r.URL.Path)
+// handle /img/{id}/raw: serve the image file, e.g., for thumbnails
+func (s *InceptionServer) handleRawImage(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	img, ok := s.getImage(w, r, params)
+	if !ok {
+		return
+	}
 
-	fname, err := s.imgDB.GetImage(idx)
+	bytes, err := s.imgDB.Bytes(img)
 	if err != nil {
-		glog.Errorf("Failed to get an image: %v", err)
-		io.WriteString(w, "Internal Error")
+		glog.Errorf("Failed to read image %v(%v): %v", img.ID, img.Name, err)
+		s.writeError(w, r, http.StatusInternalServerError, "image is not available")
 		return
 	}
 
-	s.handlePredict(w, r, fname, begin)
+	w.Header().Set("Content-Type", img.MIME)
+	// the content of an image ID never changes
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(bytes)
 }
 
-func (s *InceptionServer) handlePredict(w http.ResponseWriter, r *http.Request, fname string, begin time.Time) {
-	//1. predict the labels for the image
-	htmlTable, err := s.doPredict(fname)
+// handle /img/{id}/similar: show the images which look like the image; returns json if the client accepts it
+func (s *InceptionServer) handleSimilar(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	img, ok := s.getImage(w, r, params)
+	if !ok {
+		return
+	}
+
+	k, err := parseK(r, defaultSimilarK)
 	if err != nil {
-		io.WriteString(w, "Internal Error")
+		s.writeError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	//2. write result
-	rawImg, err := s.imgDB.GetRawImage(fname)
+	neighbors, err := s.imgDB.Similar(img.ID, k)
 	if err != nil {
-		io.WriteString(w, "Internal Error")
+		glog.Errorf("Failed to find similar images of %v: %v", img.ID, err)
+		s.fail(w, r, err)
 		return
 	}
+	similar := s.imageResults(neighbors)
 
-	//3. generate html
-	foot := s.genPageFoot(r)
+	if wantJSON(r) {
+		writeJSON(w, http.StatusOK, similar)
+		return
+	}
+
+	head, err := getHead("SimilarImages", "Similar images")
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	bytes, err := s.imgDB.Bytes(img)
+	if err != nil {
+		s.fail(w, r, fmt.Errorf("failed to read image %v(%v): %v", img.ID, img.Name, err))
+		return
+	}
+	table := getImgTable(img.ID, img.Name, img.MIME, bytes)
+	io.WriteString(w, head + table + getImageGrid(similar) + s.genPageFoot(r))
+}
+
+// thumbnails of the images which look like the image; empty if there is no embedding
+func (s *InceptionServer) similarStrip(img *tfmodel.Image) string {
+	if img.Embedding == nil {
+		return ""
+	}
+
+	neighbors, err := s.imgDB.Similar(img.ID, similarStripSize)
+	if err != nil {
+		glog.V(3).Infof("Failed to find similar images of %v: %v", img.ID, err)
+		return ""
+	}
+	return getSimilarStrip(img.ID, s.imageResults(neighbors))
+}
+
+func (s *InceptionServer) handlePredict(w http.ResponseWriter, r *http.Request, img *tfmodel.Image, begin time.Time) {
+	//0. the model selected by query parameter "model"
+	name := r.URL.Query().Get("model")
+	model, err := s.models.Get(name)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	modelID := model.Info().ID
+
+	//1. predict the labels for the image
+	htmlTable, err := s.doPredict(r, img, model)
+	if err != nil {
+		s.metrics.AddPrediction(modelID, statusCode(err), time.Since(begin))
+		s.fail(w, r, err)
+		return
+	}
+
+	//2. generate html
+	bytes, err := s.imgDB.Bytes(img)
+	if err != nil {
+		s.fail(w, r, fmt.Errorf("failed to read image %v(%v): %v", img.ID, img.Name, err))
+		return
+	}
+	foot := s.similarStrip(img) + getModelLinks(img.ID, modelID, s.models.Names()) + s.genPageFoot(r)
 	//util.TimeTrack(begin, "Predict")
-	s.metrics.AddPrediction(200, time.Since(begin))
-	io.WriteString(w, GetImgHtml(fname, rawImg, htmlTable, foot, begin))
-	s.metrics.AddHttp(200, time.Since(begin))
+	s.metrics.AddPrediction(modelID, 200, time.Since(begin))
+	io.WriteString(w, GetImgHtml(img.ID, img.Name, img.MIME, bytes, htmlTable, foot, begin))
 }
 
 // Randomly select a image, and do the prediction
-func (s *InceptionServer) handlePredictRandom(w http.ResponseWriter, r *http.Request) {
+func (s *InceptionServer) handlePredictRandom(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	glog.V(4).Infof("Begin to handle predict request: %v", r.URL.Path)
 	begin := time.Now()
 	//1. get a random image
-	fname, err := s.imgDB.GetRandomImage()
+	id, err := s.imgDB.GetRandomImage()
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+
+	img, err := s.imgDB.Get(id)
 	if err != nil {
-		glog.Errorf("Failed to get an image: %v", err)
-		io.WriteString(w, "Internal Error")
+		s.fail(w, r, err)
 		return
 	}
 
-	s.handlePredict(w, r, fname, begin)
+	s.handlePredict(w, r, img, begin)
 	return
 }
 
-func (s *InceptionServer) faviconHandler(w http.ResponseWriter, r *http.Request) {
+func (s *InceptionServer) faviconHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	fpath := "/tmp/favicon.jpg"
 	if err := tfmodel.FilesExist(fpath); err != nil {
 		glog.Warningf("favicon file[%v] does not exist.", fpath)
+		s.notFound(w, r)
 		return
 	}
 
@@ -172,31 +408,60 @@ func (s *InceptionServer) faviconHandler(w http.ResponseWriter, r *http.Request)
 	return
 }
 
-func (s *InceptionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Path
-	glog.V(3).Infof("Begin to handle path: %v", path)
-
-	if strings.EqualFold(path, "/favicon.ico") {
-		s.faviconHandler(w, r)
-		return
-	}
-
-	if strings.HasPrefix(path, "/img/random") {
-		s.handlePredictRandom(w, r)
-		return
-	}
+func (s *InceptionServer) routes() *router {
+	rt := &router{}
+	get, post := http.MethodGet, http.MethodPost
+
+	rt.handle(get, "/", s.handleWelcome)
+	rt.handle(get, "/index.html", s.handleWelcome)
+	rt.handle(get, "/index.htm", s.handleWelcome)
+	rt.handle(get, "/favicon.ico", s.faviconHandler)
+	rt.handle(get, "/metrics", s.handleMetrics)
+	rt.handle(get, "/search", s.handleLabelSearch)
+	rt.handle(get, "/healthz", s.handleHealthz)
+	rt.handle(get, "/readyz", s.handleReadyz)
+	rt.handle(get, "/statusz", s.handleStatusz)
+
+	rt.handle(get, "/img/random", s.handlePredictRandom)
+	rt.handle(get, "/img/{id}", s.handleImage)
+	rt.handle(get, "/img/{id}/similar", s.handleSimilar)
+	rt.handle(get, "/img/{id}/raw", s.handleRawImage)
+
+	rt.handle(post, "/api/v1/predict", s.handleAPIPredict)
+	rt.handle(post, "/api/v1/embed", s.handleAPIEmbed)
+	rt.handle(post, "/api/v1/search", s.handleAPISearch)
+	rt.handle(get, "/api/v1/images", s.handleAPIImages)
+	rt.handle(get, "/api/v1/records", s.handleAPIRecords)
+	rt.handle(get, "/api/v1/models", s.handleAPIListModels)
+	rt.handle(post, "/api/v1/models/{name}/predict", s.handleAPIPredict)
+	rt.handle(post, "/api/v1/models/{name}/reload", s.handleAPIReload)
+	return rt
+}
 
-	if strings.HasPrefix(path, "/img/") {
-		s.handlePredictPath(w, r)
-		return
+func (s *InceptionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	glog.V(3).Infof("Begin to handle %v %v", r.Method, r.URL.Path)
+	begin := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	defer func() {
+		s.metrics.AddHttp(sw.status(), time.Since(begin))
+	}()
+
+	// the context is canceled if the client is gone, or the timeout is exceeded
+	if s.requestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
 	}
 
-	if strings.EqualFold(path, "/metrics") {
-		s.handleMetrics(w, r)
+	handler, params, allowed := s.router.find(r)
+	switch {
+	case handler != nil:
+		handler(sw, r, params)
+	case len(allowed) > 0:
+		s.methodNotAllowed(sw, r, allowed)
+	default:
+		s.notFound(sw, r)
 	}
-
-	s.handleWelcome(w, r)
-	return
 }
 
 func (s *InceptionServer) genPageFoot (r *http.Request) string {
@@ -222,6 +487,6 @@ func (s *InceptionServer) genPageFoot (r *http.Request) string {
 	return result.String()
 }
 
-func (s *InceptionServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+func (s *InceptionServer) handleMetrics(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	s.metrics.Handle(w, r)
 }
\ No newline at end of file
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tfmodel "inceptionServer/pkg/model"
+)
+
+// newTestServer serves the fake model as "fake", with one image; it returns the image ID.
+func newTestServer(t *testing.T) (*InceptionServer, string) {
+	model := tfmodel.NewFakeClassifier(nil)
+	models := tfmodel.NewRegistry()
+	models.Add("fake", model)
+
+	content := []byte("an image")
+	input, err := model.Preprocess(context.Background(), content)
+	if err != nil {
+		t.Fatalf("failed to preprocess image: %v", err)
+	}
+	imgDB := tfmodel.NewImageDB(model)
+	id := imgDB.Add("img.jpg", input, nil, content)
+
+	s := NewInceptionServer(0, models)
+	s.SetImages(imgDB)
+	s.SetCache(tfmodel.NewPredictCache(100, 1<<20))
+	return s, id
+}
+
+func TestServeHTTP(t *testing.T) {
+	s, id := newTestServer(t)
+	upload := []byte("another image")
+
+	tests := []struct {
+		method string
+		path   string
+		body   []byte
+		code   int
+		allow  string
+	}{
+		{"GET", "/", nil, 200, ""},
+		{"HEAD", "/", nil, 200, ""},
+		{"GET", "/healthz", nil, 200, ""},
+		{"GET", "/img/random", nil, 200, ""},
+		{"GET", "/img/" + id, nil, 200, ""},
+		{"GET", "/img/" + id + "/raw", nil, 200, ""},
+		{"GET", "/img/" + id + "?model=other", nil, 404, ""},
+		{"GET", "/img/unknown", nil, 404, ""},
+		{"GET", "/unknown", nil, 404, ""},
+		{"POST", "/img/random", nil, 405, "GET, HEAD"},
+		{"GET", "/api/v1/predict", nil, 405, "POST"},
+		{"POST", "/api/v1/predict", upload, 200, ""},
+		{"POST", "/api/v1/models/fake/predict?k=3", upload, 200, ""},
+		{"POST", "/api/v1/models/other/predict", upload, 404, ""},
+		{"POST", "/api/v1/predict", nil, 400, ""},
+		{"POST", "/api/v1/predict?k=x", upload, 400, ""},
+		{"POST", "/api/v1/embed", upload, 200, ""},
+		{"POST", "/api/v1/models/fake/reload", nil, 403, ""},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(test.method, test.path, bytes.NewReader(test.body)))
+		if w.Code != test.code {
+			t.Errorf("%v %v: got %d, want %d: %s", test.method, test.path, w.Code, test.code, w.Body.String())
+		}
+		if allow := w.Header().Get("Allow"); allow != test.allow {
+			t.Errorf("%v %v: got Allow %q, want %q", test.method, test.path, allow, test.allow)
+		}
+	}
+}
+
+func TestAPIPredictCache(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	results := []*tfmodel.PredictResult{}
+	for _, cache := range []string{"MISS", "HIT"} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/predict?k=3", bytes.NewReader([]byte("another image"))))
+		if got := w.Header().Get("X-Cache"); w.Code != 200 || got != cache {
+			t.Fatalf("got %d, X-Cache %v, want 200, %v", w.Code, got, cache)
+		}
+
+		result := &tfmodel.PredictResult{}
+		if err := json.Unmarshal(w.Body.Bytes(), result); err != nil || len(result.Labels) != 3 {
+			t.Fatalf("got %s, want 3 labels: %v", w.Body.String(), err)
+		}
+		results = append(results, result)
+	}
+	if results[1].PredictMs != 0 {
+		t.Errorf("got predict_ms %v from the cache, want 0", results[1].PredictMs)
+	}
+	for i, lw := range results[1].Labels {
+		if *lw != *results[0].Labels[i] {
+			t.Errorf("label %d: got %v from the cache, want %v", i, lw, results[0].Labels[i])
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s, id := newTestServer(t)
+	// the deadline is exceeded before the prediction
+	s.SetRequestTimeout(time.Nanosecond)
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest("POST", "/api/v1/predict", bytes.NewReader([]byte("another image"))),
+		httptest.NewRequest("GET", "/img/"+id, nil),
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusGatewayTimeout {
+			t.Errorf("%v: got %d, want %d", r.URL.Path, w.Code, http.StatusGatewayTimeout)
+		}
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	for _, step := range []struct {
+		name string
+		do   func()
+		code int
+	}{
+		{"before warm-up", func() {}, 503},
+		{"after warm-up", func() { s.WarmUp() }, 200},
+		{"draining", func() { s.drain(context.Background()) }, 503},
+	} {
+		step.do()
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		if w.Code != step.code {
+			t.Errorf("%v: got %d, want %d: %s", step.name, w.Code, step.code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+
+	tfmodel "inceptionServer/pkg/model"
+)
+
+var (
+	// image ID -> json encoded Record
+	bucketImages = []byte("images")
+	// file path -> image ID
+	bucketPaths = []byte("paths")
+	// lower-case label, 0, image ID -> score
+	bucketLabels = []byte("labels")
+	// big-endian unix nano load time, image ID -> nothing
+	bucketLoaded = []byte("loaded")
+
+	buckets = [][]byte{bucketImages, bucketPaths, bucketLabels, bucketLoaded}
+)
+
+// Record is what is known about an image.
+type Record struct {
+	// ID of the image, i.e., its content hash
+	Hash  string   `json:"hash"`
+	Paths []string `json:"paths"`
+	MIME  string   `json:"mime"`
+	// size of the file in bytes
+	Size   int `json:"size"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// when the image is loaded for the first time
+	LoadedAt time.Time `json:"loaded_at"`
+	// by model version and k: "<version>/<k>"
+	Predictions map[string]*Prediction `json:"predictions"`
+}
+
+type Prediction struct {
+	Model       string                 `json:"model"`
+	Version     string                 `json:"version"`
+	K           int                    `json:"k"`
+	Labels      []*tfmodel.LabelWeight `json:"labels"`
+	PredictMs   float64                `json:"predict_ms"`
+	PredictedAt time.Time              `json:"predicted_at"`
+}
+
+// Query selects the records; the empty fields are ignored.
+type Query struct {
+	Path string
+	Hash string
+	// prefix of a predicted label, case-insensitive
+	Label    string
+	MinScore float32
+	// range of the load time
+	From  time.Time
+	To    time.Time
+	Limit int
+}
+
+/*
+ BoltStore keeps the records in a bolt database, with indexes by path, label and load time.
+ It implements tfmodel.Store.
+*/
+type BoltStore struct {
+	db *bolt.DB
+}
+
+var _ tfmodel.Store = &BoltStore{}
+
+func Open(fname string) (*BoltStore, error) {
+	db, err := bolt.Open(fname, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store %v: %v", fname, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to init store %v: %v", fname, err)
+	}
+
+	glog.V(2).Infof("Opened store %v", fname)
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func predictionKey(version string, k int) string {
+	return version + "/" + strconv.Itoa(k)
+}
+
+func loadedKey(t time.Time, id string) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return append(key, id...)
+}
+
+func labelKey(label, id string) []byte {
+	return []byte(strings.ToLower(label) + "\x00" + id)
+}
+
+func getRecord(tx *bolt.Tx, id string) (*Record, error) {
+	content := tx.Bucket(bucketImages).Get([]byte(id))
+	if content == nil {
+		return nil, nil
+	}
+
+	record := &Record{}
+	if err := json.Unmarshal(content, record); err != nil {
+		return nil, fmt.Errorf("failed to decode record %v: %v", id, err)
+	}
+	return record, nil
+}
+
+func putRecord(tx *bolt.Tx, record *Record) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketImages).Put([]byte(record.Hash), content)
+}
+
+// SaveImage records the image, or adds the file to the existing record.
+// It is called by the concurrent loaders, so the writes are batched.
+func (s *BoltStore) SaveImage(img *tfmodel.Image, fname string, loadedAt time.Time) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		record, err := getRecord(tx, img.ID)
+		if err != nil {
+			return err
+		}
+
+		if record == nil {
+			record = &Record{
+				Hash:        img.ID,
+				Paths:       []string{},
+				LoadedAt:    loadedAt,
+				Predictions: make(map[string]*Prediction),
+			}
+			if err := tx.Bucket(bucketLoaded).Put(loadedKey(loadedAt, img.ID), []byte{}); err != nil {
+				return err
+			}
+		}
+		record.MIME = img.MIME
+		record.Size = img.Size
+		record.Width = img.Width
+		record.Height = img.Height
+
+		// the file had another content before
+		if old := tx.Bucket(bucketPaths).Get([]byte(fname)); old != nil && string(old) != img.ID {
+			if err := removePath(tx, string(old), fname); err != nil {
+				return err
+			}
+		}
+		if !contains(record.Paths, fname) {
+			record.Paths = append(record.Paths, fname)
+		}
+		// the file may have had another content
+		if err := tx.Bucket(bucketPaths).Put([]byte(fname), []byte(img.ID)); err != nil {
+			return err
+		}
+
+		return putRecord(tx, record)
+	})
+}
+
+// RemovePath forgets the file, e.g., after it is removed or renamed;
+// the record and its predictions are kept, to be reused if the image is loaded again.
+func (s *BoltStore) RemovePath(fname string) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		id := tx.Bucket(bucketPaths).Get([]byte(fname))
+		if id == nil {
+			return nil
+		}
+		if err := removePath(tx, string(id), fname); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketPaths).Delete([]byte(fname))
+	})
+}
+
+// removePath removes the file from the paths of the record
+func removePath(tx *bolt.Tx, id, fname string) error {
+	record, err := getRecord(tx, id)
+	if err != nil || record == nil {
+		return err
+	}
+
+	paths := []string{}
+	for _, path := range record.Paths {
+		if path != fname {
+			paths = append(paths, path)
+		}
+	}
+	record.Paths = paths
+	return putRecord(tx, record)
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *BoltStore) GetPrediction(imageID, version string, k int) (*tfmodel.PredictResult, error) {
+	var result *tfmodel.PredictResult
+	err := s.db.View(func(tx *bolt.Tx) error {
+		record, err := getRecord(tx, imageID)
+		if err != nil || record == nil {
+			return err
+		}
+
+		p, exist := record.Predictions[predictionKey(version, k)]
+		if !exist {
+			return nil
+		}
+		result = &tfmodel.PredictResult{
+			Model:     p.Model,
+			Labels:    p.Labels,
+			PredictMs: p.PredictMs,
+		}
+		return nil
+	})
+	return result, err
+}
+
+/*
+ SavePrediction records the prediction of an image recorded by SaveImage; the predictions
+ of the other images, e.g., the uploaded ones, are not saved, so that the store is bounded
+ by the image files. The predictions of the other versions of the model are dropped, with
+ their labels, since the model is reloaded: the last saved version is the current one.
+*/
+func (s *BoltStore) SavePrediction(imageID, version string, k int, result *tfmodel.PredictResult) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		record, err := getRecord(tx, imageID)
+		if err != nil || record == nil {
+			return err
+		}
+
+		old := labelScores(record)
+		for key, p := range record.Predictions {
+			if p.Model == result.Model && p.Version != version {
+				delete(record.Predictions, key)
+			}
+		}
+		record.Predictions[predictionKey(version, k)] = &Prediction{
+			Model:       result.Model,
+			Version:     version,
+			K:           k,
+			Labels:      result.Labels,
+			PredictMs:   result.PredictMs,
+			PredictedAt: time.Now(),
+		}
+
+		// index the best score of each label by all the predictions
+		labels := tx.Bucket(bucketLabels)
+		scores := labelScores(record)
+		for label := range old {
+			if _, exist := scores[label]; exist {
+				continue
+			}
+			if err := labels.Delete(labelKey(label, imageID)); err != nil {
+				return err
+			}
+		}
+		for label, score := range scores {
+			value := make([]byte, 4)
+			binary.BigEndian.PutUint32(value, uint32(score*1e6))
+			if err := labels.Put(labelKey(label, imageID), value); err != nil {
+				return err
+			}
+		}
+
+		return putRecord(tx, record)
+	})
+}
+
+// the best score of each lower-case label by all the predictions of the record
+func labelScores(record *Record) map[string]float32 {
+	scores := make(map[string]float32)
+	for _, p := range record.Predictions {
+		for _, lw := range p.Labels {
+			label := strings.ToLower(lw.Label)
+			if lw.Weight > scores[label] {
+				scores[label] = lw.Weight
+			}
+		}
+	}
+	return scores
+}
+
+// Get returns the record of the image; nil if it is not recorded.
+func (s *BoltStore) Get(id string) (*Record, error) {
+	var result *Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		record, err := getRecord(tx, id)
+		result = record
+		return err
+	})
+	return result, err
+}
+
+// Query returns the records matching all the fields of the query.
+// The most selective index is scanned, and the other fields are filtered.
+func (s *BoltStore) Query(q *Query) ([]*Record, error) {
+	result := []*Record{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		ids, err := candidates(tx, q)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if q.Limit > 0 && len(result) >= q.Limit {
+				break
+			}
+
+			record, err := getRecord(tx, id)
+			if err != nil {
+				return err
+			}
+			if record != nil && q.match(record) {
+				result = append(result, record)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// the IDs of the images which may match the query
+func candidates(tx *bolt.Tx, q *Query) ([]string, error) {
+	switch {
+	case q.Hash != "":
+		return []string{q.Hash}, nil
+
+	case q.Path != "":
+		id := tx.Bucket(bucketPaths).Get([]byte(q.Path))
+		if id == nil {
+			return []string{}, nil
+		}
+		return []string{string(id)}, nil
+
+	case q.Label != "":
+		// the best scores first
+		scores := make(map[string]float32)
+		ids := []string{}
+		prefix := []byte(strings.ToLower(q.Label))
+		c := tx.Bucket(bucketLabels).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			parts := bytes.SplitN(k, []byte{0}, 2)
+			if len(parts) != 2 {
+				continue
+			}
+			id := string(parts[1])
+			score := float32(binary.BigEndian.Uint32(v)) / 1e6
+			if score < q.MinScore {
+				continue
+			}
+			if old, exist := scores[id]; !exist {
+				ids = append(ids, id)
+			} else if old >= score {
+				continue
+			}
+			scores[id] = score
+		}
+		sort.Sort(byScore{ids: ids, scores: scores})
+		return ids, nil
+
+	case !q.From.IsZero() || !q.To.IsZero():
+		ids := []string{}
+		c := tx.Bucket(bucketLoaded).Cursor()
+		// the key of the zero time is not the smallest one, as its unix nano is negative
+		k, _ := c.First()
+		if !q.From.IsZero() {
+			k, _ = c.Seek(loadedKey(q.From, ""))
+		}
+		for ; k != nil; k, _ = c.Next() {
+			t := time.Unix(0, int64(binary.BigEndian.Uint64(k[:8])))
+			if !q.To.IsZero() && t.After(q.To) {
+				break
+			}
+			ids = append(ids, string(k[8:]))
+		}
+		return ids, nil
+	}
+
+	ids := []string{}
+	err := tx.Bucket(bucketImages).ForEach(func(k, v []byte) error {
+		ids = append(ids, string(k))
+		return nil
+	})
+	return ids, err
+}
+
+type byScore struct {
+	ids    []string
+	scores map[string]float32
+}
+
+func (s byScore) Len() int           { return len(s.ids) }
+func (s byScore) Swap(i, j int)      { s.ids[i], s.ids[j] = s.ids[j], s.ids[i] }
+func (s byScore) Less(i, j int) bool { return s.scores[s.ids[i]] > s.scores[s.ids[j]] }
+
+func (q *Query) match(r *Record) bool {
+	if q.Hash != "" && r.Hash != q.Hash {
+		return false
+	}
+	if q.Path != "" && !contains(r.Paths, q.Path) {
+		return false
+	}
+	if !q.From.IsZero() && r.LoadedAt.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && r.LoadedAt.After(q.To) {
+		return false
+	}
+	if q.Label != "" && !r.hasLabel(q.Label, q.MinScore) {
+		return false
+	}
+	return true
+}
+
+func (r *Record) hasLabel(prefix string, minScore float32) bool {
+	prefix = strings.ToLower(prefix)
+	for _, p := range r.Predictions {
+		for _, lw := range p.Labels {
+			if strings.HasPrefix(strings.ToLower(lw.Label), prefix) && lw.Weight >= minScore {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	tfmodel "inceptionServer/pkg/model"
+)
+
+func openTestStore(t *testing.T) (*BoltStore, func()) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	s, err := Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to open store: %v", err)
+	}
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	s, cleanup := openTestStore(t)
+	defer cleanup()
+
+	day := func(d int) time.Time {
+		return time.Date(2018, 1, d, 12, 0, 0, 0, time.UTC)
+	}
+	images := []struct {
+		id, fname string
+		loadedAt  time.Time
+		labels    []*tfmodel.LabelWeight
+	}{
+		{"a", "/img/a.jpg", day(1), []*tfmodel.LabelWeight{tfmodel.NewLabelWeight("tabby cat", 0.9), tfmodel.NewLabelWeight("tiger cat", 0.05)}},
+		{"b", "/img/b.jpg", day(2), []*tfmodel.LabelWeight{tfmodel.NewLabelWeight("Tiger cat", 0.6), tfmodel.NewLabelWeight("tabby cat", 0.3)}},
+		{"c", "/img/c.jpg", day(3), []*tfmodel.LabelWeight{tfmodel.NewLabelWeight("sports car", 0.8), tfmodel.NewLabelWeight("convertible", 0.1)}},
+		{"c", "/img/c-copy.jpg", day(4), nil},
+		// the predictions of the images not loaded from files, e.g., the uploaded ones, are not saved
+		{"uploaded", "", time.Time{}, []*tfmodel.LabelWeight{tfmodel.NewLabelWeight("tabby cat", 0.9)}},
+	}
+	for _, img := range images {
+		if img.fname != "" {
+			if err := s.SaveImage(&tfmodel.Image{ID: img.id, MIME: "image/jpeg"}, img.fname, img.loadedAt); err != nil {
+				t.Fatalf("failed to save image %v: %v", img.id, err)
+			}
+		}
+		if img.labels != nil {
+			result := &tfmodel.PredictResult{Model: "inception", Labels: img.labels}
+			if err := s.SavePrediction(img.id, "v1", len(img.labels), result); err != nil {
+				t.Fatalf("failed to save prediction of %v: %v", img.id, err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query *Query
+		ids   []string
+	}{
+		{"all", &Query{}, []string{"a", "b", "c"}},
+		{"limit", &Query{Limit: 2}, []string{"a", "b"}},
+		{"hash", &Query{Hash: "b"}, []string{"b"}},
+		{"path", &Query{Path: "/img/c-copy.jpg"}, []string{"c"}},
+		{"label by score", &Query{Label: "tabby"}, []string{"a", "b"}},
+		{"label case", &Query{Label: "TIGER"}, []string{"b", "a"}},
+		{"min score", &Query{Label: "tabby", MinScore: 0.5}, []string{"a"}},
+		{"unknown label", &Query{Label: "dog"}, []string{}},
+		// the load time of a record is the first one
+		{"from", &Query{From: day(2)}, []string{"b", "c"}},
+		{"to", &Query{To: day(2)}, []string{"a", "b"}},
+		{"label and date", &Query{Label: "tabby", From: day(2)}, []string{"b"}},
+	}
+
+	for _, test := range tests {
+		records, err := s.Query(test.query)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		ids := []string{}
+		for _, r := range records {
+			ids = append(ids, r.Hash)
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%v: got %v, want %v", test.name, ids, test.ids)
+		}
+	}
+
+	if result, err := s.GetPrediction("a", "v1", 2); err != nil || result == nil || result.Labels[0].Label != "tabby cat" {
+		t.Errorf("got %v, %v, want the prediction of a", result, err)
+	}
+	if result, err := s.GetPrediction("a", "v2", 2); err != nil || result != nil {
+		t.Errorf("got %v, %v, want no prediction of another version", result, err)
+	}
+
+	// the predictions of the old version, and their labels, are dropped with a new version
+	result := &tfmodel.PredictResult{Model: "inception", Labels: []*tfmodel.LabelWeight{tfmodel.NewLabelWeight("beagle", 0.7)}}
+	if err := s.SavePrediction("a", "v2", 1, result); err != nil {
+		t.Fatalf("failed to save prediction of a: %v", err)
+	}
+	if result, err := s.GetPrediction("a", "v1", 2); err != nil || result != nil {
+		t.Errorf("got %v, %v, want no prediction of the old version", result, err)
+	}
+	for label, want := range map[string]int{"tabby": 1, "beagle": 1} {
+		if records, err := s.Query(&Query{Label: label}); err != nil || len(records) != want {
+			t.Errorf("%v: got %d records, %v, want %d", label, len(records), err, want)
+		}
+	}
+}
+
+func TestRemovePath(t *testing.T) {
+	s, cleanup := openTestStore(t)
+	defer cleanup()
+
+	for _, fname := range []string{"/img/a.jpg", "/img/copy.jpg"} {
+		if err := s.SaveImage(&tfmodel.Image{ID: "a"}, fname, time.Now()); err != nil {
+			t.Fatalf("failed to save image: %v", err)
+		}
+	}
+	if err := s.RemovePath("/img/a.jpg"); err != nil {
+		t.Fatalf("failed to remove path: %v", err)
+	}
+
+	// the record is kept for the image to be loaded again
+	record, err := s.Get("a")
+	if err != nil || record == nil || !reflect.DeepEqual(record.Paths, []string{"/img/copy.jpg"}) {
+		t.Errorf("got %v, %v, want the paths [/img/copy.jpg]", record, err)
+	}
+}
@@ -0,0 +1,179 @@
+package tfgraph
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	tf "github.com/tensorflow/tensorflow/tensorflow/go"
+
+	tfmodel "inceptionServer/pkg/model"
+)
+
+/*
+ Batcher collects the concurrent prediction requests, and runs them as one batch:
+ a batch is run when it has maxBatchSize requests, or maxWait has passed since
+ its first request arrived. The requests whose context is done before their batch
+ runs are skipped.
+*/
+type Batcher struct {
+	model        *TfModel
+	maxBatchSize int
+	maxWait      time.Duration
+	workers      int
+
+	requests chan *batchRequest
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+type batchRequest struct {
+	ctx      context.Context
+	tensor   *tf.Tensor
+	enqueued time.Time
+	result   chan *batchResult
+}
+
+type batchResult struct {
+	probabilities []float32
+	err           error
+}
+
+func NewBatcher(m *TfModel, maxBatchSize int, maxWait time.Duration, workers int) *Batcher {
+	if maxBatchSize < 1 {
+		maxBatchSize = 1
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &Batcher{
+		model:        m,
+		maxBatchSize: maxBatchSize,
+		maxWait:      maxWait,
+		workers:      workers,
+		// unbuffered: a request is accepted only when a worker takes it.
+		requests: make(chan *batchRequest),
+		stop:     make(chan struct{}),
+	}
+}
+
+func (b *Batcher) Start() {
+	glog.V(2).Infof("Start batcher: maxBatchSize=%d, maxWait=%v, workers=%d",
+		b.maxBatchSize, b.maxWait, b.workers)
+	for i := 0; i < b.workers; i++ {
+		b.wg.Add(1)
+		go b.loop()
+	}
+}
+
+// Stop waits for the running batches to finish.
+func (b *Batcher) Stop() {
+	b.stopOnce.Do(func() {
+		close(b.stop)
+	})
+	b.wg.Wait()
+}
+
+// PredictTensor returns when the batch of the tensor is run, or ctx is done.
+func (b *Batcher) PredictTensor(ctx context.Context, tensor *tf.Tensor) ([]float32, error) {
+	req := &batchRequest{
+		ctx:      ctx,
+		tensor:   tensor,
+		enqueued: time.Now(),
+		result:   make(chan *batchResult, 1),
+	}
+
+	select {
+	case b.requests <- req:
+	case <-b.stop:
+		return []float32{}, tfmodel.NewError(tfmodel.KindUnavailable, "batcher is stopped")
+	case <-ctx.Done():
+		return []float32{}, tfmodel.ContextError(ctx)
+	}
+
+	// the result channel is buffered, so the batch does not wait for a request which is gone
+	select {
+	case result := <-req.result:
+		return result.probabilities, result.err
+	case <-ctx.Done():
+		return []float32{}, tfmodel.ContextError(ctx)
+	}
+}
+
+func (b *Batcher) loop() {
+	defer b.wg.Done()
+
+	for {
+		var first *batchRequest
+		select {
+		case first = <-b.requests:
+		case <-b.stop:
+			return
+		}
+
+		b.run(b.collect(first))
+	}
+}
+
+// collect more requests for the batch, until it is full or timeout
+func (b *Batcher) collect(first *batchRequest) []*batchRequest {
+	batch := []*batchRequest{first}
+	if b.maxBatchSize < 2 {
+		return batch
+	}
+
+	timer := time.NewTimer(b.maxWait)
+	defer timer.Stop()
+
+	for len(batch) < b.maxBatchSize {
+		select {
+		case req := <-b.requests:
+			batch = append(batch, req)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (b *Batcher) run(batch []*batchRequest) {
+	batch = b.skipDone(batch)
+	if len(batch) < 1 {
+		return
+	}
+
+	now := time.Now()
+	tensors := make([]*tf.Tensor, len(batch))
+	for i, req := range batch {
+		tensors[i] = req.tensor
+		queueWait.WithLabelValues(b.model.ID).Observe(now.Sub(req.enqueued).Seconds() * 1000.0)
+	}
+	batchSize.WithLabelValues(b.model.ID).Observe(float64(len(batch)))
+	glog.V(4).Infof("Run a batch of %d images", len(batch))
+
+	rows, err := b.model.PredictBatch(tensors)
+	for i, req := range batch {
+		if err != nil {
+			req.result <- &batchResult{err: err}
+			continue
+		}
+		req.result <- &batchResult{probabilities: rows[i]}
+	}
+}
+
+// skipDone answers the requests whose context is done, and returns the others.
+func (b *Batcher) skipDone(batch []*batchRequest) []*batchRequest {
+	result := batch[:0]
+	for _, req := range batch {
+		if err := tfmodel.ContextError(req.ctx); err != nil {
+			skippedPredictions.WithLabelValues(b.model.ID).Inc()
+			req.result <- &batchResult{err: err}
+			continue
+		}
+		result = append(result, req)
+	}
+	return result
+}
@@ -0,0 +1,92 @@
+package tfgraph
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/golang/glog"
+	tf "github.com/tensorflow/tensorflow/tensorflow/go"
+
+	tfmodel "inceptionServer/pkg/model"
+)
+
+var (
+	_ tfmodel.Embedder = &TfModel{}
+	_ tfmodel.Embedder = &ReloadableModel{}
+)
+
+func (m *TfModel) Embed(ctx context.Context, bytes []byte) ([]float32, error) {
+	input, err := m.Preprocess(ctx, bytes)
+	if err != nil {
+		glog.Errorf("Failed to construct tensor: %v", err)
+		return nil, err
+	}
+	return m.EmbedInput(ctx, input)
+}
+
+func (m *TfModel) EmbedInput(ctx context.Context, input tfmodel.Input) ([]float32, error) {
+	tensor, ok := input.(*tf.Tensor)
+	if !ok {
+		return nil, fmt.Errorf("unexpected input type for model %v: %T", m.ID, input)
+	}
+	return m.EmbedTensor(ctx, tensor)
+}
+
+// EmbedTensor fetches the output of Config.EmbeddingOp, flattened into a vector.
+func (m *TfModel) EmbedTensor(ctx context.Context, tensor *tf.Tensor) ([]float32, error) {
+	if m.Config.EmbeddingOp == "" {
+		return nil, tfmodel.ErrNoEmbedding
+	}
+	if err := tfmodel.ContextError(ctx); err != nil {
+		return nil, err
+	}
+	defer observeStage(time.Now(), m.ID, stageEmbed)
+
+	output, err := m.run(tensor, m.Config.EmbeddingOp)
+	if err != nil {
+		glog.Errorf("Failed to run session to embed: %v", err)
+		return nil, err
+	}
+
+	result := []float32{}
+	if err := flatten(reflect.ValueOf(output.Value()), &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// flatten the nested slices of float32 into a vector
+func flatten(v reflect.Value, result *[]float32) error {
+	switch v.Kind() {
+	case reflect.Float32:
+		*result = append(*result, float32(v.Float()))
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := flatten(v.Index(i), result); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unexpected embedding value type: %v", v.Type())
+	}
+	return nil
+}
+
+func (r *ReloadableModel) Embed(ctx context.Context, bytes []byte) ([]float32, error) {
+	v := r.acquire()
+	defer v.release()
+	return v.model.Embed(ctx, bytes)
+}
+
+func (r *ReloadableModel) EmbedInput(ctx context.Context, input tfmodel.Input) ([]float32, error) {
+	v := r.acquire()
+	defer v.release()
+
+	input, err := r.input(v, input)
+	if err != nil {
+		return nil, err
+	}
+	return v.model.EmbedInput(ctx, input)
+}
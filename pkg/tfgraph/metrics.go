@@ -0,0 +1,56 @@
+package tfgraph
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	stageSessionCreate = "session_create"
+	stageNormalize     = "normalize"
+	stageInference     = "inference"
+	stageEmbed         = "embed"
+)
+
+var (
+	stageLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "model_stage_millseconds",
+		Help:    "Time taken by each stage of a prediction: session creation, image normalization, inference and embedding",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 16),
+	}, []string{"model", "stage"})
+
+	batchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "batch_size",
+		Help:    "Number of images in each batch run by the batcher",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+	}, []string{"model"})
+
+	queueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "batch_queue_wait_millseconds",
+		Help:    "Time a prediction request waits in the batcher before its batch runs",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"model"})
+
+	skippedPredictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "batch_skipped_total",
+		Help: "Number of queued predictions skipped as their requests are canceled or timed out",
+	}, []string{"model"})
+
+	modelReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "model_reloads_total",
+		Help: "Number of model reloads, by result: success or failure",
+	}, []string{"model", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(stageLatency)
+	prometheus.MustRegister(batchSize)
+	prometheus.MustRegister(queueWait)
+	prometheus.MustRegister(skippedPredictions)
+	prometheus.MustRegister(modelReloads)
+}
+
+func observeStage(start time.Time, model, stage string) {
+	stageLatency.WithLabelValues(model, stage).Observe(time.Since(start).Seconds() * 1000.0)
+}
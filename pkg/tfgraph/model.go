@@ -0,0 +1,617 @@
+package tfgraph
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/golang/glog"
+
+	"bufio"
+	tf "github.com/tensorflow/tensorflow/tensorflow/go"
+	"github.com/tensorflow/tensorflow/tensorflow/go/op"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	tfmodel "inceptionServer/pkg/model"
+)
+
+type TfModel struct {
+	Graph    *tf.Graph
+	Labels   []string
+	ModelDir string
+	// read from the manifest in ModelDir
+	Config *tfmodel.ModelConfig
+	// ID identifies the model in the prediction results
+	ID string
+	// ReuseSession keeps the sessions open between predictions;
+	// otherwise a new session is created for every prediction.
+	ReuseSession bool
+
+	// protects the sessions from being closed while in use
+	lock       sync.RWMutex
+	closed     bool
+	session    *tf.Session
+	normalizer *imageNormalizer
+
+	batcher  *Batcher
+	loadedAt time.Time
+	loadTime time.Duration
+	// SHA-256 of the model file
+	checksum string
+	// changed if the graph, the labels or the preprocessing is changed
+	version string
+}
+
+func NewModel(mdir string) *TfModel {
+	return &TfModel{
+		ModelDir:     mdir,
+		Config:       tfmodel.DefaultModelConfig(),
+		ID:           filepath.Base(filepath.Clean(mdir)),
+		ReuseSession: true,
+	}
+}
+
+func (m *TfModel) Init() error {
+	if len(m.ModelDir) < 1 {
+		glog.Errorf("modelDir is empty")
+		return fmt.Errorf("modelDir is empty")
+	}
+	glog.V(2).Infof("begin to load model from: %v", m.ModelDir)
+	begin := time.Now()
+
+	config, err := tfmodel.LoadModelConfig(m.ModelDir)
+	if err != nil {
+		glog.Errorf("Failed to load model config from %v: %v", m.ModelDir, err)
+		return err
+	}
+	m.Config = config
+
+	modelfile, labelfile, err := m.modelFiles(m.ModelDir)
+	if err != nil {
+		err := fmt.Errorf("Failed to find model files in %v: %v", m.ModelDir, err)
+		glog.Error(err.Error())
+		return err
+	}
+
+	//1. load model
+	glog.V(2).Infof("Begin to load model from %v", modelfile)
+	model, err := ioutil.ReadFile(modelfile)
+	if err != nil {
+		err := fmt.Errorf("Failed ot read model file(%v): %v", modelfile, err)
+		glog.Errorf(err.Error())
+		return err
+	}
+	m.checksum = fmt.Sprintf("%x", sha256.Sum256(model))
+	m.Graph = tf.NewGraph()
+	if err := m.Graph.Import(model, ""); err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	for _, name := range []string{config.InputOp, config.OutputOp} {
+		if m.Graph.Operation(name) == nil {
+			err := fmt.Errorf("operation %v is not found in model file %v", name, modelfile)
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	if config.EmbeddingOp != "" && m.Graph.Operation(config.EmbeddingOp) == nil {
+		glog.Warningf("Embedding operation %v is not found in model file %v, embedding is disabled.",
+			config.EmbeddingOp, modelfile)
+		config.EmbeddingOp = ""
+	}
+
+	//2. load labels
+	if m.Labels, err = loadLabels(labelfile); err != nil {
+		glog.Errorf("Failed to load labels(%v): %v", labelfile, err)
+		return err
+	}
+
+	glog.V(2).Infof("Load %d labels from %v.", len(m.Labels), labelfile)
+	m.version = tfmodel.VersionOf(m.checksum, config, m.Labels)
+
+	//3. start the sessions
+	if m.ReuseSession {
+		if err := m.initSessions(); err != nil {
+			glog.Errorf("Failed to start sessions: %v", err)
+			return err
+		}
+	}
+	m.loadedAt = time.Now()
+	m.loadTime = time.Since(begin)
+	return nil
+}
+
+func (m *TfModel) initSessions() error {
+	session, err := newSession(m.Graph, m.ID)
+	if err != nil {
+		return fmt.Errorf("failed to create session for model: %v", err)
+	}
+
+	normalizer, err := newImageNormalizer(m.ID, m.Config, tfFormats)
+	if err != nil {
+		session.Close()
+		return fmt.Errorf("failed to create image normalizer: %v", err)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.session = session
+	m.normalizer = normalizer
+	return nil
+}
+
+// EnableBatching makes the predictions go through a Batcher;
+// it should be called before the model serves any prediction.
+func (m *TfModel) EnableBatching(maxBatchSize int, maxWait time.Duration, workers int) {
+	if maxBatchSize < 2 {
+		glog.V(2).Infof("Batching is disabled: max batch size is %d", maxBatchSize)
+		return
+	}
+
+	m.batcher = NewBatcher(m, maxBatchSize, maxWait, workers)
+	m.batcher.Start()
+}
+
+// Close releases the sessions of the model; it waits for the running predictions.
+func (m *TfModel) Close() error {
+	if m.batcher != nil {
+		m.batcher.Stop()
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+
+	var result error
+	if m.normalizer != nil {
+		if err := m.normalizer.Close(); err != nil {
+			glog.Errorf("Failed to close normalizer session: %v", err)
+			result = err
+		}
+		m.normalizer = nil
+	}
+
+	if m.session != nil {
+		if err := m.session.Close(); err != nil {
+			glog.Errorf("Failed to close model session: %v", err)
+			result = err
+		}
+		m.session = nil
+	}
+
+	glog.V(2).Infof("Model %v is closed.", m.ID)
+	return result
+}
+
+func (m *TfModel) Preprocess(ctx context.Context, bytes []byte) (tfmodel.Input, error) {
+	if err := tfmodel.ContextError(ctx); err != nil {
+		return nil, err
+	}
+	return m.MakeTensorFromImage(bytes)
+}
+
+func (m *TfModel) PredictTopKInput(ctx context.Context, input tfmodel.Input, k int) (*tfmodel.PredictResult, error) {
+	tensor, ok := input.(*tf.Tensor)
+	if !ok {
+		return nil, fmt.Errorf("unexpected input type for model %v: %T", m.ID, input)
+	}
+	return m.PredictTopKTensor(ctx, tensor, k)
+}
+
+func (m *TfModel) GetLabels() []string {
+	return m.Labels
+}
+
+func (m *TfModel) Info() *tfmodel.ModelInfo {
+	return &tfmodel.ModelInfo{
+		ID:          m.ID,
+		ModelDir:    m.ModelDir,
+		NumLabels:   len(m.Labels),
+		InputShape:  []int{m.Config.Height, m.Config.Width, 3},
+		EmbeddingOp: m.Config.EmbeddingOp,
+		Checksum:    m.checksum,
+		Version:     m.version,
+		LoadedAt:    m.loadedAt,
+		LoadMs:      m.loadTime.Seconds() * 1000,
+	}
+}
+
+/* return modelfile, labelfile, error */
+func (m *TfModel) modelFiles(dir string) (string, string, error) {
+	URL := m.Config.DownloadURL
+	modelfile := filepath.Join(dir, m.Config.ModelFile)
+	labelfile := filepath.Join(dir, m.Config.LabelFile)
+	zipfile := filepath.Join(dir, filepath.Base(URL))
+
+	if err := tfmodel.FilesExist(modelfile, labelfile); err == nil || URL == "" {
+		return modelfile, labelfile, err
+	}
+
+	glog.Warningf("Did not find model in %v, will download from %v", dir, URL)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		glog.Errorf("Failed to create dir: %v", dir)
+		return "", "", err
+	}
+	if err := download(URL, zipfile); err != nil {
+		return "", "", fmt.Errorf("failed to download %v - %v", URL, err)
+	}
+	if err := unzip(dir, zipfile); err != nil {
+		return "", "", fmt.Errorf("failed to extract contents from model archive: %v", err)
+	}
+	os.Remove(zipfile)
+	return modelfile, labelfile, tfmodel.FilesExist(modelfile, labelfile)
+}
+
+// ModelFiles returns the model file and the label file in the dir, as named by its manifest.
+func ModelFiles(dir string) (string, string, error) {
+	config, err := tfmodel.LoadModelConfig(dir)
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(dir, config.ModelFile), filepath.Join(dir, config.LabelFile), nil
+}
+
+// DownloadModel downloads the model into the dir if its files are missing, see ModelConfig.DownloadURL.
+func DownloadModel(dir string) (string, string, error) {
+	config, err := tfmodel.LoadModelConfig(dir)
+	if err != nil {
+		return "", "", err
+	}
+
+	m := NewModel(dir)
+	m.Config = config
+	return m.modelFiles(dir)
+}
+
+func loadLabels(fname string) ([]string, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		glog.Errorf(err.Error())
+		return nil, err
+	}
+
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	var labels []string
+	for scanner.Scan() {
+		labels = append(labels, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		glog.Errorf("ERROR: failed to read %s: %v", fname, err)
+		return nil, err
+	}
+
+	return labels, nil
+}
+
+func (m *TfModel) PredictTopkFile(ctx context.Context, fname string, k int) (*tfmodel.PredictResult, error) {
+	glog.V(2).Infof("Begin to predict data from file %v", fname)
+	bytes, err := ioutil.ReadFile(fname)
+	if err != nil {
+		glog.Errorf("failed to read image file %v: %v", fname, err)
+		return nil, err
+	}
+
+	return m.PredictTopK(ctx, bytes, k)
+}
+
+func (m *TfModel) PredictTopK(ctx context.Context, bytes []byte, k int) (*tfmodel.PredictResult, error) {
+	begin := time.Now()
+	probabilities, err := m.PredictImage(ctx, bytes)
+	if err != nil {
+		glog.Errorf("Predict failed: %v", err)
+		return nil, err
+	}
+
+	return m.getTopK(probabilities, k, begin)
+}
+
+func (m *TfModel) PredictTopKTensor(ctx context.Context, tensor *tf.Tensor, k int) (*tfmodel.PredictResult, error) {
+	begin := time.Now()
+	probabilities, err := m.PredictTensor(ctx, tensor)
+	if err != nil {
+		glog.Errorf("Predict failed: %v", err)
+		return nil, err
+	}
+
+	return m.getTopK(probabilities, k, begin)
+}
+
+func (m *TfModel) getTopK(probabilities []float32, k int, begin time.Time) (*tfmodel.PredictResult, error) {
+	return tfmodel.TopK(m.ID, m.Labels, probabilities, k, begin)
+}
+
+/*
+ PredictTensor goes through the batcher if batching is enabled. It is not run if ctx
+ is done before; a running session can not be interrupted, but the result is dropped.
+*/
+func (m *TfModel) PredictTensor(ctx context.Context, tensor *tf.Tensor) ([]float32, error) {
+	if m.batcher != nil {
+		return m.batcher.PredictTensor(ctx, tensor)
+	}
+	if err := tfmodel.ContextError(ctx); err != nil {
+		return []float32{}, err
+	}
+
+	rows, err := m.PredictBatch([]*tf.Tensor{tensor})
+	if err != nil {
+		return []float32{}, err
+	}
+	return rows[0], nil
+}
+
+// PredictBatch stacks the normalized tensors into one input, and runs the graph once.
+func (m *TfModel) PredictBatch(tensors []*tf.Tensor) ([][]float32, error) {
+	result := [][]float32{}
+	if len(tensors) < 1 {
+		return result, nil
+	}
+
+	input := tensors[0]
+	if len(tensors) > 1 {
+		batch, err := stackTensors(tensors)
+		if err != nil {
+			glog.Errorf("Failed to stack %d tensors: %v", len(tensors), err)
+			return result, err
+		}
+		input = batch
+	}
+
+	defer timeTrack(time.Now(), "predict")
+	defer observeStage(time.Now(), m.ID, stageInference)
+
+	//3. execute the graph
+	output, err := m.run(input, m.Config.OutputOp)
+	if err != nil {
+		glog.Errorf("Failed to run session to predict %v", err)
+		return result, err
+	}
+
+	//4. get output, one row for each input image
+	probabilities := output.Value().([][]float32)
+	if len(probabilities) != len(tensors) {
+		err := fmt.Errorf("got %d results for %d images", len(probabilities), len(tensors))
+		glog.Error(err.Error())
+		return result, err
+	}
+	return probabilities, nil
+}
+
+// run the graph with the input, and fetch the output of the operation.
+func (m *TfModel) run(input *tf.Tensor, fetch string) (*tf.Tensor, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, fmt.Errorf("model %v is closed", m.ID)
+	}
+
+	session := m.session
+	if session == nil {
+		tmp, err := newSession(m.Graph, m.ID)
+		if err != nil {
+			glog.Errorf("Failed to create a new session to predict: %v", err)
+			return nil, err
+		}
+		defer tmp.Close()
+		session = tmp
+	}
+
+	graph := m.Graph
+	output, err := session.Run(
+		map[tf.Output]*tf.Tensor{
+			graph.Operation(m.Config.InputOp).Output(0): input,
+		},
+		[]tf.Output{
+			graph.Operation(fetch).Output(0),
+		},
+		nil)
+	if err != nil {
+		return nil, err
+	}
+	return output[0], nil
+}
+
+// stackTensors concatenates the [1,H,W,3] tensors into a [N,H,W,3] tensor.
+func stackTensors(tensors []*tf.Tensor) (*tf.Tensor, error) {
+	batch := [][][][]float32{}
+	for _, t := range tensors {
+		v, ok := t.Value().([][][][]float32)
+		if !ok {
+			return nil, fmt.Errorf("unexpected tensor value type: %T", t.Value())
+		}
+		batch = append(batch, v...)
+	}
+	return tf.NewTensor(batch)
+}
+
+func (m *TfModel) PredictImage(ctx context.Context, bytes []byte) ([]float32, error) {
+	defer timeTrack(time.Now(), "predict.bytes.wallclock")
+	result := []float32{}
+	if err := tfmodel.ContextError(ctx); err != nil {
+		return result, err
+	}
+
+	tensor, err := m.MakeTensorFromImage(bytes)
+	if err != nil {
+		glog.Errorf("Failed to construct tensor: %v", err)
+		return result, err
+	}
+
+	return m.PredictTensor(ctx, tensor)
+}
+
+func (m *TfModel) PredictFile(ctx context.Context, fname string) ([]float32, error) {
+	defer timeTrack(time.Now(), "predict.file.wallclock")
+	result := []float32{}
+
+	//1. prepare input for model
+	bytes, err := ioutil.ReadFile(fname)
+	if err != nil {
+		glog.Errorf("Failed to load image from %v: %v", fname, err)
+		return result, err
+	}
+
+	return m.PredictImage(ctx, bytes)
+}
+
+func MakeTensorFromFile(filename string) (*tf.Tensor, error) {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		glog.Errorf("Failed to load image from %v: %v", filename, err)
+		return nil, err
+	}
+
+	return MakeTensorFromImage(bytes)
+}
+
+func LoadImage(fname string) ([]byte, *tf.Tensor, error) {
+	return loadImage(fname, MakeTensorFromImage)
+}
+
+// LoadImage reads the image file, and normalizes it with the sessions of the model.
+func (m *TfModel) LoadImage(fname string) ([]byte, *tf.Tensor, error) {
+	return loadImage(fname, m.MakeTensorFromImage)
+}
+
+func loadImage(fname string, makeTensor func([]byte) (*tf.Tensor, error)) ([]byte, *tf.Tensor, error) {
+	bytes, err := ioutil.ReadFile(fname)
+	if err != nil {
+		glog.Errorf("Failed to load image from %v: %v", fname, err)
+		return []byte{}, nil, err
+	}
+
+	tensor, err := makeTensor(bytes)
+	if err != nil {
+		glog.Errorf("Failed to construct tensor for file %v: %v", fname, err)
+		return []byte{}, nil, err
+	}
+
+	return bytes, tensor, err
+}
+
+// MakeTensorFromImage normalizes the image with the long-lived session of the model.
+func (m *TfModel) MakeTensorFromImage(bytes []byte) (*tf.Tensor, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, fmt.Errorf("model %v is closed", m.ID)
+	}
+
+	if m.normalizer == nil {
+		return makeTensorFromImage(bytes, m.ID, m.Config)
+	}
+	return m.normalizer.Normalize(bytes)
+}
+
+/*
+makeTensorFromImage and constructGraphToNormlizeImage are copied from tensorflow.org.
+*/
+// Convert the image in filename to a Tensor suitable as input to the Inception model.
+func MakeTensorFromImage(bytes []byte) (*tf.Tensor, error) {
+	return makeTensorFromImage(bytes, "", tfmodel.DefaultModelConfig())
+}
+
+func makeTensorFromImage(bytes []byte, model string, config *tfmodel.ModelConfig) (*tf.Tensor, error) {
+	format, bytes, err := detectTfFormat(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Construct a graph and a session to normalize this one image, of its format only
+	normalizer, err := newImageNormalizer(model, config, []string{format})
+	if err != nil {
+		return nil, err
+	}
+	defer normalizer.Close()
+
+	return normalizer.Normalize(bytes)
+}
+
+// The model takes as input the image described by a Tensor in a very
+// specific normalized format (a particular image size, shape of the input tensor,
+// normalized pixel values etc.), which is described by the ModelConfig.
+//
+// This function constructs a graph of TensorFlow operations which takes as
+// input an encoded image string in the given format, and returns a tensor
+// suitable as input to the model.
+func constructGraphToNormalizeImage(format string, config *tfmodel.ModelConfig) (graph *tf.Graph, input, output tf.Output, err error) {
+	// For the pre-trained model at:
+	// https://storage.googleapis.com/download.tensorflow.org/models/inception5h.zip
+	//
+	// - The model was trained after with images scaled to 224x224 pixels.
+	// - The colors, represented as R, G, B in 1-byte each were converted to
+	//   float using (value - Mean)/Std, where Mean=117 and Std=1.
+	H, W := int32(config.Height), int32(config.Width)
+
+	// - input is a String-Tensor, where the string the encoded image.
+	// - The model takes a 4D tensor of shape
+	//   [BatchSize, Height, Width, Colors=3], where each pixel is
+	//   represented as a triplet of floats
+	// - Apply normalization on each pixel and use ExpandDims to make
+	//   this single image be a "batch" of size 1 for the resize.
+	s := op.NewScope()
+	input = op.Placeholder(s, tf.String)
+
+	var decoded tf.Output
+	makeBatch := op.Const(s.SubScope("make_batch"), int32(0))
+	switch format {
+	case tfmodel.FormatJPEG:
+		decoded = op.ExpandDims(s, op.DecodeJpeg(s, input, op.DecodeJpegChannels(3)), makeBatch)
+	case tfmodel.FormatPNG:
+		decoded = op.ExpandDims(s, op.DecodePng(s, input, op.DecodePngChannels(3)), makeBatch)
+	case tfmodel.FormatBMP:
+		decoded = op.ExpandDims(s, op.DecodeBmp(s, input, op.DecodeBmpChannels(3)), makeBatch)
+	case tfmodel.FormatGIF:
+		// DecodeGif returns all the frames [NumFrames, Height, Width, 3]; use the first one.
+		decoded = op.Slice(s, op.DecodeGif(s, input),
+			op.Const(s.SubScope("frame_begin"), []int32{0, 0, 0, 0}),
+			op.Const(s.SubScope("frame_size"), []int32{1, -1, -1, -1}))
+	default:
+		return nil, input, output, fmt.Errorf("no decoder for image format %q", format)
+	}
+
+	pixels := op.Cast(s, decoded, tf.Float)
+	size := op.Const(s.SubScope("size"), []int32{H, W})
+	var resized tf.Output
+	switch config.Resize {
+	case tfmodel.ResizeArea:
+		resized = op.ResizeArea(s, pixels, size)
+	case tfmodel.ResizeCenterCrop:
+		// crop the central region of the image, and resize it to the input size.
+		f := config.CentralFraction
+		lo, hi := (1-f)/2, (1+f)/2
+		resized = op.CropAndResize(s, pixels,
+			op.Const(s.SubScope("crop_box"), [][]float32{{lo, lo, hi, hi}}),
+			op.Const(s.SubScope("crop_index"), []int32{0}),
+			size)
+	default:
+		resized = op.ResizeBilinear(s, pixels, size)
+	}
+
+	if config.ChannelOrder == tfmodel.ChannelBGR {
+		resized = op.ReverseV2(s, resized, op.Const(s.SubScope("channel_axis"), []int32{3}))
+	}
+
+	output = op.Div(s,
+		op.Sub(s,
+			resized,
+			channelConst(s.SubScope("mean"), config.Mean)),
+		channelConst(s.SubScope("std"), config.Std))
+	graph, err = s.Finalize()
+	return graph, input, output, err
+}
+
+// channelConst is a scalar for one value, or a vector broadcast over the channels.
+func channelConst(s *op.Scope, values []float32) tf.Output {
+	if len(values) == 1 {
+		return op.Const(s, values[0])
+	}
+	return op.Const(s, values)
+}
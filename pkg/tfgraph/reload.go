@@ -0,0 +1,319 @@
+package tfgraph
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+
+	tfmodel "inceptionServer/pkg/model"
+)
+
+/*
+ ReloadableModel is a Classifier which serves the current version of a TfModel.
+ Reload loads a new version from the model dir in the background, and swaps it in
+ when it passes a smoke prediction; the old version is closed after its in-flight
+ predictions finish. If the reload fails, the old version keeps serving.
+*/
+type ReloadableModel struct {
+	name string
+	dir  string
+	// load creates and initializes a new version of the model
+	load func() (*TfModel, error)
+
+	lock    sync.RWMutex
+	current *modelVersion
+	// one reload at a time
+	reloadLock sync.Mutex
+	// the hooks run one reload at a time too, but outside reloadLock
+	hooksLock sync.Mutex
+	hooks     []func(old, new *tfmodel.ModelInfo)
+	// number of reloads in progress, until their hooks finish
+	reloading int32
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+type modelVersion struct {
+	model    *TfModel
+	inflight sync.WaitGroup
+}
+
+var _ tfmodel.Classifier = &ReloadableModel{}
+
+func NewReloadableModel(name, dir string, load func() (*TfModel, error)) (*ReloadableModel, error) {
+	model, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReloadableModel{
+		name:    name,
+		dir:     dir,
+		load:    load,
+		current: &modelVersion{model: model},
+		stop:    make(chan struct{}),
+	}, nil
+}
+
+// OnReload registers a function called with the info of the old and the new versions after a reload.
+func (r *ReloadableModel) OnReload(hook func(old, new *tfmodel.ModelInfo)) {
+	r.hooksLock.Lock()
+	defer r.hooksLock.Unlock()
+	r.hooks = append(r.hooks, hook)
+}
+
+// acquire the current version; it is not closed until released.
+func (r *ReloadableModel) acquire() *modelVersion {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	v := r.current
+	v.inflight.Add(1)
+	return v
+}
+
+func (v *modelVersion) release() {
+	v.inflight.Done()
+}
+
+func (r *ReloadableModel) Pin() (tfmodel.Classifier, func()) {
+	v := r.acquire()
+	return v.model, v.release
+}
+
+// Current returns the TfModel being served.
+func (r *ReloadableModel) Current() *TfModel {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.current.model
+}
+
+/*
+ Reload loads and swaps in a new version. Then the old version is closed after its
+ in-flight predictions, and the hooks are run, e.g., to preprocess the images again,
+ outside the reload lock. Reloading is true until the hooks finish.
+*/
+func (r *ReloadableModel) Reload() error {
+	atomic.AddInt32(&r.reloading, 1)
+	defer atomic.AddInt32(&r.reloading, -1)
+
+	begin := time.Now()
+	old, model, err := r.swap()
+	if err != nil {
+		return r.reloadFailed(err)
+	}
+
+	// drain the in-flight predictions of the old version
+	oldInfo, newInfo := old.model.Info(), model.Info()
+	old.inflight.Wait()
+	old.model.Close()
+
+	r.hooksLock.Lock()
+	for _, hook := range r.hooks {
+		hook(oldInfo, newInfo)
+	}
+	r.hooksLock.Unlock()
+
+	modelReloads.WithLabelValues(r.name, "success").Inc()
+	glog.V(1).Infof("Reloaded model %v in %v, checksum: %v", r.name, time.Since(begin), model.checksum)
+	return nil
+}
+
+// swap loads a new version, and swaps it in if it passes a smoke prediction; returns the old and the new versions.
+func (r *ReloadableModel) swap() (*modelVersion, *TfModel, error) {
+	r.reloadLock.Lock()
+	defer r.reloadLock.Unlock()
+
+	glog.V(1).Infof("Begin to reload model %v from %v", r.name, r.dir)
+	model, err := r.load()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load: %v", err)
+	}
+
+	if err := smokeTest(model); err != nil {
+		model.Close()
+		return nil, nil, fmt.Errorf("smoke prediction failed: %v", err)
+	}
+
+	r.lock.Lock()
+	old := r.current
+	r.current = &modelVersion{model: model}
+	r.lock.Unlock()
+	return old, model, nil
+}
+
+func (r *ReloadableModel) Reloading() bool {
+	return atomic.LoadInt32(&r.reloading) > 0
+}
+
+// Verify checks the current version with a smoke prediction.
+func (r *ReloadableModel) Verify() error {
+	v := r.acquire()
+	defer v.release()
+	return v.model.Verify()
+}
+
+func (r *ReloadableModel) reloadFailed(err error) error {
+	modelReloads.WithLabelValues(r.name, "failure").Inc()
+	err = fmt.Errorf("failed to reload model %v, keep serving the old version: %v", r.name, err)
+	glog.Error(err.Error())
+	return err
+}
+
+// Verify predicts a generated image with the model, to check that it works.
+func (m *TfModel) Verify() error {
+	return smokeTest(m)
+}
+
+// smokeTest predicts a generated image with the model
+func smokeTest(m *TfModel) error {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 4), G: uint8(y * 4), B: 128, A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+
+	result, err := m.PredictTopK(context.Background(), buf.Bytes(), 1)
+	if err != nil {
+		return err
+	}
+	if len(result.Labels) < 1 {
+		return fmt.Errorf("no label is predicted")
+	}
+	return nil
+}
+
+// WatchFiles reloads the model when its files are changed; the files are checked every interval.
+func (r *ReloadableModel) WatchFiles(interval time.Duration) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last := r.filesModTime()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				t := r.filesModTime()
+				if !t.After(last) {
+					continue
+				}
+				glog.V(2).Infof("Files of model %v are changed.", r.name)
+				last = t
+				r.Reload()
+			}
+		}
+	}()
+}
+
+// the latest modification time of the model file, label file and manifest
+func (r *ReloadableModel) filesModTime() time.Time {
+	config := r.Current().Config
+	result := time.Time{}
+	for _, fname := range []string{config.ModelFile, config.LabelFile, tfmodel.ModelConfigFile} {
+		info, err := os.Stat(filepath.Join(r.dir, fname))
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(result) {
+			result = info.ModTime()
+		}
+	}
+	return result
+}
+
+func (r *ReloadableModel) PredictTopK(ctx context.Context, bytes []byte, k int) (*tfmodel.PredictResult, error) {
+	v := r.acquire()
+	defer v.release()
+	return v.model.PredictTopK(ctx, bytes, k)
+}
+
+// versionInput is an input of ReloadableModel, with the version which preprocessed it.
+type versionInput struct {
+	model *TfModel
+	input tfmodel.Input
+}
+
+func (r *ReloadableModel) Preprocess(ctx context.Context, bytes []byte) (tfmodel.Input, error) {
+	v := r.acquire()
+	defer v.release()
+
+	input, err := v.model.Preprocess(ctx, bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &versionInput{model: v.model, input: input}, nil
+}
+
+/*
+ input returns the input for the version v; an input preprocessed by a previous version is rejected
+ if the version is changed, e.g., its preprocessing. Pin the model to preprocess and predict with one version.
+*/
+func (r *ReloadableModel) input(v *modelVersion, input tfmodel.Input) (tfmodel.Input, error) {
+	vi, ok := input.(*versionInput)
+	if !ok {
+		return input, nil
+	}
+	if vi.model.version != v.model.version {
+		return nil, tfmodel.NewError(tfmodel.KindUnavailable, "the input is preprocessed by a previous version of model %v", r.name)
+	}
+	return vi.input, nil
+}
+
+func (r *ReloadableModel) PredictTopKInput(ctx context.Context, input tfmodel.Input, k int) (*tfmodel.PredictResult, error) {
+	v := r.acquire()
+	defer v.release()
+
+	input, err := r.input(v, input)
+	if err != nil {
+		return nil, err
+	}
+	return v.model.PredictTopKInput(ctx, input, k)
+}
+
+func (r *ReloadableModel) GetLabels() []string {
+	return r.Current().GetLabels()
+}
+
+func (r *ReloadableModel) Info() *tfmodel.ModelInfo {
+	return r.Current().Info()
+}
+
+func (r *ReloadableModel) Close() error {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+	r.wg.Wait()
+
+	r.reloadLock.Lock()
+	defer r.reloadLock.Unlock()
+
+	r.lock.RLock()
+	v := r.current
+	r.lock.RUnlock()
+
+	v.inflight.Wait()
+	return v.model.Close()
+}
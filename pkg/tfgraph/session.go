@@ -0,0 +1,149 @@
+package tfgraph
+
+import (
+	"image"
+	"time"
+
+	"github.com/golang/glog"
+	tf "github.com/tensorflow/tensorflow/tensorflow/go"
+
+	tfmodel "inceptionServer/pkg/model"
+)
+
+var (
+	// image formats decoded by tensorflow; the others are transcoded to PNG first.
+	tfFormats = []string{tfmodel.FormatJPEG, tfmodel.FormatPNG, tfmodel.FormatGIF, tfmodel.FormatBMP}
+)
+
+/*
+ imageNormalizer owns the graphs built by constructGraphToNormalizeImage, one for
+ each of its image formats, and a long-lived session for each graph, so the graphs
+ are built only once. A tf.Session can be used by several goroutines concurrently.
+*/
+type imageNormalizer struct {
+	// ID of the model, used in metrics
+	model  string
+	graphs map[string]*normalizeGraph
+}
+
+type normalizeGraph struct {
+	graph   *tf.Graph
+	session *tf.Session
+	input   tf.Output
+	output  tf.Output
+}
+
+// newImageNormalizer builds the graphs of the formats, e.g., tfFormats.
+func newImageNormalizer(model string, config *tfmodel.ModelConfig, formats []string) (*imageNormalizer, error) {
+	n := &imageNormalizer{
+		model:  model,
+		graphs: make(map[string]*normalizeGraph),
+	}
+
+	for _, format := range formats {
+		g, err := newNormalizeGraph(model, format, config)
+		if err != nil {
+			n.Close()
+			return nil, err
+		}
+		n.graphs[format] = g
+	}
+
+	return n, nil
+}
+
+func newNormalizeGraph(model, format string, config *tfmodel.ModelConfig) (*normalizeGraph, error) {
+	graph, input, output, err := constructGraphToNormalizeImage(format, config)
+	if err != nil {
+		glog.Errorf("Failed to construct graph to normalize %v image: %v", format, err)
+		return nil, err
+	}
+
+	session, err := newSession(graph, model)
+	if err != nil {
+		glog.Errorf("Failed to start session to normalize %v image: %v", format, err)
+		return nil, err
+	}
+
+	return &normalizeGraph{
+		graph:   graph,
+		session: session,
+		input:   input,
+		output:  output,
+	}, nil
+}
+
+/*
+ detectTfFormat detects the format of the image, and transcodes it to PNG if tensorflow
+ can not decode it; returns one of tfFormats, and the bytes to decode.
+*/
+func detectTfFormat(bytes []byte) (string, []byte, error) {
+	format := tfmodel.DetectFormat(bytes)
+	if format == tfmodel.FormatWebP {
+		png, err := tfmodel.TranscodeToPNG(bytes)
+		if err == image.ErrFormat {
+			// no decoder is linked in
+			return "", nil, tfmodel.NewError(tfmodel.KindUnsupported, "%v image is not supported", format)
+		}
+		if err != nil {
+			glog.V(3).Infof("Failed to transcode %v image: %v", format, err)
+			return "", nil, tfmodel.NewError(tfmodel.KindInvalid, "failed to decode %v image: %v", format, err)
+		}
+		return tfmodel.FormatPNG, png, nil
+	}
+
+	for _, f := range tfFormats {
+		if f == format {
+			return format, bytes, nil
+		}
+	}
+	return "", nil, tfmodel.ErrUnknownFormat
+}
+
+// Normalize detects the format of the image, and decodes it with the graph of the format;
+// a corrupt image is an Error of KindInvalid, and an unknown format of KindUnsupported.
+func (n *imageNormalizer) Normalize(bytes []byte) (*tf.Tensor, error) {
+	format, bytes, err := detectTfFormat(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	g, ok := n.graphs[format]
+	if !ok {
+		return nil, tfmodel.ErrUnknownFormat
+	}
+
+	// the decode ops use a scalar String-valued tensor as input.
+	tensor, err := tf.NewTensor(string(bytes))
+	if err != nil {
+		glog.Errorf("Failed to costruct tensor from bytes: %v", err)
+		return nil, err
+	}
+
+	defer observeStage(time.Now(), n.model, stageNormalize)
+	normalized, err := g.session.Run(
+		map[tf.Output]*tf.Tensor{g.input: tensor},
+		[]tf.Output{g.output},
+		nil)
+	if err != nil {
+		glog.V(3).Infof("Failed to normalize %v image: %v", format, err)
+		return nil, tfmodel.NewError(tfmodel.KindInvalid, "failed to decode %v image: %v", format, err)
+	}
+	return normalized[0], nil
+}
+
+func (n *imageNormalizer) Close() error {
+	var result error
+	for format, g := range n.graphs {
+		if err := g.session.Close(); err != nil {
+			glog.Errorf("Failed to close session of %v graph: %v", format, err)
+			result = err
+		}
+	}
+	return result
+}
+
+func newSession(graph *tf.Graph, model string) (*tf.Session, error) {
+	defer observeStage(time.Now(), model, stageSessionCreate)
+	return tf.NewSession(graph, nil)
+}
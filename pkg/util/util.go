@@ -19,7 +19,7 @@ func NewMetrics() *ServerMetrics {
 	predict := prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "predict_millseconds",
 		Help: "Time taken to predict labels for image",
-	}, []string{"code"})
+	}, []string{"model", "code"})
 
 	http := prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "page_resp_millseconds",
@@ -36,8 +36,8 @@ func NewMetrics() *ServerMetrics {
 	}
 }
 
-func (m *ServerMetrics) AddPrediction(code int, du time.Duration) {
-	m.prediction_resp.WithLabelValues(fmt.Sprintf("%d", code)).Observe(du.Seconds()*1000.0)
+func (m *ServerMetrics) AddPrediction(model string, code int, du time.Duration) {
+	m.prediction_resp.WithLabelValues(model, fmt.Sprintf("%d", code)).Observe(du.Seconds()*1000.0)
 }
 
 func (m *ServerMetrics) AddHttp(code int, du time.Duration) {
@@ -90,18 +90,3 @@ func ExternalIP() (string, error) {
 	}
 	return "", fmt.Errorf("are you connected to the network?")
 }
-
-func StringToInt(path string) int {
-	if len(path) < 1 {
-		return 0
-	}
-
-	bbuf := []byte(path)
-
-	result := 0
-	for i := 0; i < len(bbuf); i ++ {
-		result += int(bbuf[i])
-	}
-
-	return result
-}
\ No newline at end of file
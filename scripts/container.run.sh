@@ -45,4 +45,5 @@ opts="$opts --imgdir=$imgdir"
 cmd="$serverbin $opts"
 echo "$cmd"
 
-$cmd
+# exec, so the server gets SIGTERM, and drains the requests in flight
+exec $cmd